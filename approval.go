@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/crosbymichael/octokat"
+	"github.com/docker/leeroy/github"
+)
+
+const (
+	// defaultApprovalCommand is the comment that approves testing a pull
+	// request if the config does not say otherwise.
+	defaultApprovalCommand = "/ok-to-test"
+	// defaultApprovalLabel is the label that approves testing a pull
+	// request if the config does not say otherwise.
+	defaultApprovalLabel = "ok-to-test"
+)
+
+// defaultTrustedAssociations are the associations with a repository of the
+// authors whose pull requests are built without approval, and of the users
+// who can approve the others.
+var defaultTrustedAssociations = []string{"OWNER", "MEMBER", "COLLABORATOR"}
+
+// approvalStore remembers which pull requests were approved for testing by
+// comment. Approvals with a sha only hold for that head of the pull request.
+type approvalStore struct {
+	mu        sync.Mutex
+	approvals map[string]string
+}
+
+var approvals = &approvalStore{approvals: map[string]string{}}
+
+// approve approves testing a pull request, or only its head sha if sha is
+// not empty.
+func (s *approvalStore) approve(repo string, pr int, sha string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.approvals[prKey(repo, pr)] = sha
+}
+
+// approved returns if testing the head sha of a pull request was approved.
+func (s *approvalStore) approved(repo string, pr int, sha string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	approved, ok := s.approvals[prKey(repo, pr)]
+	return ok && (approved == "" || approved == sha)
+}
+
+// forget removes the approval of a pull request.
+func (s *approvalStore) forget(repo string, pr int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.approvals, prKey(repo, pr))
+}
+
+// trusted returns if users with an association to the repository, like
+// "MEMBER", are trusted.
+func (rc RepoConfig) trusted(association string) bool {
+	trusted := rc.TrustedAssociations
+	if len(trusted) == 0 {
+		trusted = defaultTrustedAssociations
+	}
+
+	for _, a := range trusted {
+		if strings.EqualFold(a, association) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rc RepoConfig) approvalCommand() string {
+	if rc.ApprovalCommand == "" {
+		return defaultApprovalCommand
+	}
+	return rc.ApprovalCommand
+}
+
+func (rc RepoConfig) approvalLabel() string {
+	if rc.ApprovalLabel == "" {
+		return defaultApprovalLabel
+	}
+	return rc.ApprovalLabel
+}
+
+// awaitingApproval returns if a pull request needs to be approved before it
+// is built, and sets a pending status for the build saying so if it does.
+func (c Config) awaitingApproval(baseRepo string, number int, build Build) (bool, error) {
+	rc := c.getRepoConfig(baseRepo)
+	if !rc.RequireApproval {
+		return false, nil
+	}
+
+	r := strings.SplitN(baseRepo, "/", 2)
+	if len(r) < 2 {
+		return false, fmt.Errorf("repo name could not be parsed: %s", baseRepo)
+	}
+
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	pr, err := g.GetPullRequestDetails(repo, number)
+	if err != nil {
+		return false, fmt.Errorf("getting pull request %s#%d failed: %v", baseRepo, number, err)
+	}
+	if rc.trusted(pr.AuthorAssociation) || pr.HasLabel(rc.approvalLabel()) || approvals.approved(baseRepo, number, pr.Head.Sha) {
+		return false, nil
+	}
+
+	desc := fmt.Sprintf("Awaiting approval, a maintainer can comment %s or add the %s label", rc.approvalCommand(), rc.approvalLabel())
+	url := fmt.Sprintf("https://github.com/%s/pull/%d", baseRepo, number)
+	if err := c.updateGithubStatus(baseRepo, build.Context, pr.Head.Sha, "pending", desc, url); err != nil {
+		return true, err
+	}
+
+	logrus.Infof("Not building %s for %s#%d by %s author until it is approved", build.Job, baseRepo, number, strings.ToLower(pr.AuthorAssociation))
+	return true, nil
+}
+
+// requireReapproval removes the approval of a pull request by an untrusted
+// author that was pushed to, if the repository asks for it.
+func (c Config) requireReapproval(baseRepo string, pr *octokat.PullRequest, author string) error {
+	rc := c.getRepoConfig(baseRepo)
+	if !rc.RequireApproval || !rc.ReapproveOnPush || rc.trusted(author) {
+		return nil
+	}
+
+	approvals.forget(baseRepo, pr.Number)
+
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     pr.Base.Repo.Name,
+		UserName: pr.Base.Repo.Owner.Login,
+	}
+	return g.RemoveLabel(repo, pr.Number, rc.approvalLabel())
+}
+
+// approvePR approves testing a pull request and builds it like its webhook
+// would. The approval label is added to the pull request too, so the
+// approval is kept on github and outlives leeroy.
+func (c Config) approvePR(baseRepo string, number int, approver string) error {
+	rc := c.getRepoConfig(baseRepo)
+
+	prHook, details, err := c.pullRequestHook(baseRepo, number)
+	if err != nil {
+		return err
+	}
+
+	var sha string
+	if rc.ReapproveOnPush {
+		sha = prHook.PullRequest.Head.Sha
+	}
+	approvals.approve(baseRepo, number, sha)
+	logrus.Infof("%s approved testing %s#%d", approver, baseRepo, number)
+
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     prHook.Repo.Name,
+		UserName: prHook.Repo.Owner.Login,
+	}
+	if err := g.AddLabel(repo, number, rc.approvalLabel()); err != nil {
+		logrus.Warnf("adding label %s to %s#%d failed: %v", rc.approvalLabel(), baseRepo, number, err)
+	}
+
+	return c.buildPullRequest(prHook, details)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/crosbymichael/octokat"
+	"github.com/docker/leeroy/github"
+)
+
+const (
+	// defaultMergeCommand is the comment that asks leeroy to merge a pull
+	// request once it can be, if the config does not say otherwise.
+	defaultMergeCommand = "/merge"
+	// defaultAutoMergeLabel is the label that asks leeroy to merge a pull
+	// request once it can be, if the config does not say otherwise.
+	defaultAutoMergeLabel = "automerge"
+	// defaultAutoMergeContext is the context of the status saying what a
+	// pull request waits for before it is merged, if the config does not say
+	// otherwise.
+	defaultAutoMergeContext = "leeroy/automerge"
+	// defaultMergeMethod is how pull requests are merged if the config does
+	// not say otherwise.
+	defaultMergeMethod = "merge"
+)
+
+// mergeRequests remembers the pull requests that were asked to be merged by
+// comment, and by whom.
+type mergeRequests struct {
+	mu  sync.Mutex
+	prs map[string]string
+}
+
+var merges = &mergeRequests{prs: map[string]string{}}
+
+// request asks for a pull request to be merged.
+func (m *mergeRequests) request(repo string, pr int, user string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prs[prKey(repo, pr)] = user
+}
+
+// requested returns if a pull request was asked to be merged.
+func (m *mergeRequests) requested(repo string, pr int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.prs[prKey(repo, pr)]
+	return ok
+}
+
+// forget removes the request to merge a pull request.
+func (m *mergeRequests) forget(repo string, pr int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.prs, prKey(repo, pr))
+}
+
+func (rc RepoConfig) mergeCommand() string {
+	if rc.MergeCommand == "" {
+		return defaultMergeCommand
+	}
+	return rc.MergeCommand
+}
+
+func (rc RepoConfig) autoMergeLabel() string {
+	if rc.AutoMergeLabel == "" {
+		return defaultAutoMergeLabel
+	}
+	return rc.AutoMergeLabel
+}
+
+func (rc RepoConfig) autoMergeContext() string {
+	if rc.AutoMergeContext == "" {
+		return defaultAutoMergeContext
+	}
+	return rc.AutoMergeContext
+}
+
+func (rc RepoConfig) mergeMethod() string {
+	if rc.MergeMethod == "" {
+		return defaultMergeMethod
+	}
+	return rc.MergeMethod
+}
+
+// requestMerge asks for a pull request to be merged once it can be.
+func (c Config) requestMerge(repoName string, number int, user string) error {
+	merges.request(repoName, number, user)
+	logrus.Infof("%s asked to merge %s#%d", user, repoName, number)
+
+	return c.tryAutoMerge(repoName, number)
+}
+
+// tryAutoMerge merges a pull request that was asked to be merged, if all the
+// contexts required for it passed, it has enough approving reviews and it
+// can be merged. Otherwise it sets a status saying what the pull request is
+// waiting for.
+func (c Config) tryAutoMerge(repoName string, number int) error {
+	rc := c.getRepoConfig(repoName)
+	if !rc.AutoMerge {
+		return nil
+	}
+
+	r := strings.SplitN(repoName, "/", 2)
+	if len(r) < 2 {
+		return fmt.Errorf("repo name could not be parsed: %s", repoName)
+	}
+
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	pr, err := g.GetPullRequestDetails(repo, number)
+	if err != nil {
+		return fmt.Errorf("getting pull request %s#%d failed: %v", repoName, number, err)
+	}
+	if pr.State != "open" {
+		merges.forget(repoName, number)
+		return nil
+	}
+	if !pr.HasLabel(rc.autoMergeLabel()) && !merges.requested(repoName, number) {
+		return nil
+	}
+
+	sha := pr.Head.Sha
+	url := fmt.Sprintf("https://github.com/%s/pull/%d", repoName, number)
+	setStatus := func(state, desc string) error {
+		return c.updateGithubStatus(repoName, rc.autoMergeContext(), sha, state, desc, url)
+	}
+
+	// wait for the builds
+	required, states, err := c.requiredStates(repoName, sha)
+	if err != nil {
+		return err
+	}
+	if len(required) == 0 {
+		return setStatus("pending", "Waiting for the builds to be scheduled")
+	}
+	switch state, desc := summarize(required, states); state {
+	case "pending":
+		return setStatus("pending", "Waiting for the builds: "+desc)
+	case "failure":
+		return setStatus("failure", "Not merging, the builds failed: "+desc)
+	}
+
+	// wait for the reviews
+	if rc.RequiredApprovals > 0 {
+		approvals, err := g.ApprovingReviews(repo, number)
+		if err != nil {
+			return fmt.Errorf("getting reviews of %s#%d failed: %v", repoName, number, err)
+		}
+		if approvals < rc.RequiredApprovals {
+			return setStatus("pending", fmt.Sprintf("Waiting for approving reviews, %d of %d", approvals, rc.RequiredApprovals))
+		}
+	}
+
+	// github computes if the pull request can be merged in the background
+	if pr.Mergeable == nil {
+		return setStatus("pending", "Waiting for GitHub to check if the pull request can be merged")
+	}
+	if !*pr.Mergeable {
+		return setStatus("failure", fmt.Sprintf("Not merging, the pull request conflicts with %s", pr.Base.Ref))
+	}
+
+	// the merge queue tests the pull request with the others before
+	// merging it
+	if rc.MergeQueue != nil {
+		switch pos := c.enqueuePR(repoName, pr.Base.Ref, number, sha); pos {
+		case 0:
+			return nil
+		default:
+			return setStatus("pending", fmt.Sprintf("Queued for merging into %s, position %d", pr.Base.Ref, pos))
+		}
+	}
+
+	if err := g.MergePullRequest(repo, number, sha, rc.mergeMethod()); err != nil {
+		if err := setStatus("error", "Merging the pull request failed"); err != nil {
+			logrus.Error(err)
+		}
+		return fmt.Errorf("merging %s#%d failed: %v", repoName, number, err)
+	}
+	merges.forget(repoName, number)
+
+	logrus.Infof("Merged %s#%d at %s with method %s", repoName, number, sha, rc.mergeMethod())
+	return setStatus("success", fmt.Sprintf("Merged with method %s", rc.mergeMethod()))
+}
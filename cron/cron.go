@@ -0,0 +1,212 @@
+// Package cron parses cron expressions and finds the times they match.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxYears is how far ahead Next looks for a matching time.
+const maxYears = 5
+
+// field describes the range of a field of a cron expression.
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// shorthands are the expressions that can be used instead of the five
+// fields.
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@nightly":  "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// days are matched if either the day of month or the day of week
+	// matches, unless one of them is a wildcard
+	domAny, dowAny bool
+}
+
+// Parse parses a cron expression of five fields: minute, hour, day of month,
+// month and day of week. Fields can be wildcards, lists, ranges and steps,
+// like "*/15 9-17 * * mon-fri", or one of the shorthands like "@daily".
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if s, ok := shorthands[strings.ToLower(expr)]; ok {
+		expr = s
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, has %d", expr, len(fields))
+	}
+
+	var (
+		s   Schedule
+		err error
+	)
+	if s.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, err
+	}
+
+	// sunday is both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*" || fields[2] == "?"
+	s.dowAny = fields[4] == "*" || fields[4] == "?"
+
+	return &s, nil
+}
+
+// parseField returns the bits of the values a field of an expression matches.
+func parseField(expr string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		min, max, step := f.min, f.max, 1
+
+		rng := part
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s %q", f.name, part)
+			}
+			rng = part[:i]
+		}
+
+		switch {
+		case rng == "*" || rng == "?":
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			var err error
+			if min, err = f.value(rng[:i]); err != nil {
+				return 0, err
+			}
+			if max, err = f.value(rng[i+1:]); err != nil {
+				return 0, err
+			}
+			if min > max {
+				return 0, fmt.Errorf("invalid range in %s %q", f.name, part)
+			}
+		default:
+			v, err := f.value(rng)
+			if err != nil {
+				return 0, err
+			}
+			min = v
+			// a single value with a step runs until the end of the range
+			if !strings.Contains(part, "/") {
+				max = v
+			}
+		}
+
+		for v := min; v <= max; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// value parses a single value of a field.
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", f.name, s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s %d is not between %d and %d", f.name, v, f.min, f.max)
+	}
+
+	return v, nil
+}
+
+// Next returns the first time after t the schedule matches, in the location
+// of t. It returns the zero time if the schedule never matches, like on the
+// 30th of February.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxYears, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// matchesDay returns if the schedule matches the day of t.
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
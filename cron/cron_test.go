@@ -0,0 +1,69 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInvalid(t *testing.T) {
+	exprs := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+	}
+
+	for _, expr := range exprs {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("expected an error for %q", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// a wednesday
+	from := time.Date(2016, time.June, 15, 10, 30, 20, 0, time.UTC)
+
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2016, time.June, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2016, time.June, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2016, time.June, 16, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2016, time.June, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2016, time.June, 15, 11, 0, 0, 0, time.UTC)},
+		{"30 9 * * mon-fri", time.Date(2016, time.June, 16, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2016, time.June, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,20 * *", time.Date(2016, time.June, 20, 12, 0, 0, 0, time.UTC)},
+		// either the day of month or the day of week
+		{"0 12 1 * fri", time.Date(2016, time.June, 17, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("parsing %q failed: %v", c.expr, err)
+		}
+		if next := s.Next(from); !next.Equal(c.expected) {
+			t.Fatalf("expected %s, was %s, for: %s\n", c.expected, next, c.expr)
+		}
+	}
+}
+
+func TestNextNever(t *testing.T) {
+	s, err := Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Fatalf("expected no next time, was %s", next)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/crosbymichael/octokat"
+	"github.com/docker/leeroy/github"
+)
+
+// pendingPush is a push whose builds wait for the debounce window to pass.
+type pendingPush struct {
+	sha   string
+	timer *time.Timer
+}
+
+// pushDebouncer delays the builds of pushes to pull requests, so only the
+// last of the pushes in quick succession is built.
+type pushDebouncer struct {
+	mu     sync.Mutex
+	pushes map[string]*pendingPush
+}
+
+var debouncer = &pushDebouncer{pushes: map[string]*pendingPush{}}
+
+// debounce runs fn once no other push for the key came in for the window,
+// instead of the fn of the previous push if it did not run yet. It returns
+// the sha of that previous push.
+func (d *pushDebouncer) debounce(key, sha string, window time.Duration, fn func()) (superseded string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p, ok := d.pushes[key]; ok && p.timer.Stop() {
+		superseded = p.sha
+	}
+
+	p := &pendingPush{sha: sha}
+	p.timer = time.AfterFunc(window, func() {
+		d.mu.Lock()
+		current := d.pushes[key] == p
+		if current {
+			delete(d.pushes, key)
+		}
+		d.mu.Unlock()
+
+		if current {
+			fn()
+		}
+	})
+	d.pushes[key] = p
+
+	return superseded
+}
+
+// cancel drops the pending push for the key.
+func (d *pushDebouncer) cancel(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p, ok := d.pushes[key]; ok {
+		p.timer.Stop()
+		delete(d.pushes, key)
+	}
+}
+
+// debouncePush builds the head of a pull request that was pushed to once the
+// debounce window of the repository passed without another push, and marks
+// the head of the push it supersedes.
+func (c Config) debouncePush(prHook *octokat.PullRequestHook, details github.PullRequestHookDetails) {
+	pr := prHook.PullRequest
+	baseRepo := fmt.Sprintf("%s/%s", pr.Base.Repo.Owner.Login, pr.Base.Repo.Name)
+	window := time.Duration(c.getRepoConfig(baseRepo).DebounceWindow) * time.Second
+
+	superseded := debouncer.debounce(prKey(baseRepo, pr.Number), pr.Head.Sha, window, func() {
+		if err := c.buildPullRequest(prHook, details); err != nil {
+			logrus.Error(err)
+		}
+	})
+	logrus.Infof("Building %s#%d at %s in %s unless it is pushed to again", baseRepo, pr.Number, pr.Head.Sha, window)
+
+	if superseded == "" || superseded == pr.Head.Sha {
+		return
+	}
+	if err := c.markSuperseded(baseRepo, pr.Number, superseded, pr.Head.Sha); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// markSuperseded sets the status of the builds of a commit that is not built
+// because a newer commit was pushed to the pull request right after it.
+func (c Config) markSuperseded(baseRepo string, number int, sha, newSha string) error {
+	builds, err := c.getBuilds(baseRepo, false, false)
+	if err != nil {
+		return err
+	}
+
+	desc := fmt.Sprintf("Build superseded by newer push %s", shortSha(newSha))
+	url := fmt.Sprintf("https://github.com/%s/pull/%d", baseRepo, number)
+	for _, build := range builds {
+		if build.Job == "" {
+			continue
+		}
+		if err := c.updateGithubStatus(baseRepo, build.Context, sha, "pending", desc, url); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Not building %s of %s#%d, it was superseded by %s", sha, baseRepo, number, newSha)
+	return nil
+}
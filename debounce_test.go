@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPushDebouncer(t *testing.T) {
+	d := &pushDebouncer{pushes: map[string]*pendingPush{}}
+	built := make(chan string, 3)
+	build := func(sha string) func() {
+		return func() { built <- sha }
+	}
+
+	key := prKey("docker/docker", 1)
+	if superseded := d.debounce(key, "a", time.Hour, build("a")); superseded != "" {
+		t.Fatalf("expected the first push not to supersede another, superseded %s", superseded)
+	}
+	if superseded := d.debounce(key, "b", 10*time.Millisecond, build("b")); superseded != "a" {
+		t.Fatalf("expected the push of b to supersede a, superseded %q", superseded)
+	}
+	// pushes to other pull requests are debounced on their own
+	d.debounce(prKey("docker/docker", 2), "c", time.Hour, build("c"))
+	d.cancel(prKey("docker/docker", 2))
+
+	select {
+	case sha := <-built:
+		if sha != "b" {
+			t.Fatalf("expected b to be built, built %s", sha)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected b to be built once the window passed")
+	}
+
+	select {
+	case sha := <-built:
+		t.Fatalf("expected only b to be built, built %s too", sha)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
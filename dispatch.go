@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The priority classes of builds waiting to be dispatched to jenkins. By
+// default builds are dispatched in this order.
+const (
+	priorityRetry      = "retry"
+	priorityMaintainer = "maintainer"
+	priorityRelease    = "release"
+	priorityDefault    = "default"
+	priorityCron       = "cron"
+)
+
+var defaultPriorities = map[string]int{
+	priorityRetry:      0,
+	priorityMaintainer: 1,
+	priorityRelease:    2,
+	priorityDefault:    3,
+	priorityCron:       4,
+}
+
+// dispatchInterval is how often the dispatch queue is checked for builds
+// that fit under the limits, next to when builds complete.
+const dispatchInterval = 30 * time.Second
+
+// DispatchConfig describes how many builds leeroy runs on jenkins at once.
+// Builds over the limits wait in leeroy's queue, ordered by the priority of
+// their class and then by how many builds their repository runs.
+type DispatchConfig struct {
+	// RepoLimits are the number of builds of a repository that run at
+	// once, by repository. DefaultRepoLimit applies to the others, no limit
+	// if it is 0.
+	RepoLimits       map[string]int `json:"repo_limits"`
+	DefaultRepoLimit int            `json:"default_repo_limit"`
+	// JobLimits are the number of builds of a job that run at once on
+	// each jenkins master, by job name. A limit named like "master/job"
+	// applies to the job on that master only, and takes precedence.
+	JobLimits map[string]int `json:"job_limits"`
+	// Priorities overrides the priorities of the classes, lower first.
+	Priorities map[string]int `json:"priorities"`
+	// ReleaseBranches are the patterns of the branches, like "release/*",
+	// whose builds and pull requests have the release class.
+	ReleaseBranches []string `json:"release_branches"`
+}
+
+func (dc DispatchConfig) repoLimit(repo string) int {
+	if l, ok := dc.RepoLimits[repo]; ok {
+		return l
+	}
+	return dc.DefaultRepoLimit
+}
+
+func (dc DispatchConfig) jobLimit(jenkins, job string) int {
+	if l, ok := dc.JobLimits[jobKey(jenkins, job)]; ok {
+		return l
+	}
+	return dc.JobLimits[job]
+}
+
+func (dc DispatchConfig) priority(class string) int {
+	if p, ok := dc.Priorities[class]; ok {
+		return p
+	}
+	return defaultPriorities[class]
+}
+
+func (dc DispatchConfig) isRelease(branch string) bool {
+	for _, pattern := range dc.ReleaseBranches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type priorityKey struct{}
+
+// withPriority returns a context that makes the builds scheduled with it
+// have the priority class, unless it already has a class.
+func withPriority(ctx context.Context, class string) context.Context {
+	if _, ok := ctx.Value(priorityKey{}).(string); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, priorityKey{}, class)
+}
+
+// priorityClass returns the class of a build for a branch scheduled with the
+// context.
+func (dc DispatchConfig) priorityClass(ctx context.Context, branch string) string {
+	class, _ := ctx.Value(priorityKey{}).(string)
+	switch {
+	case class != "" && class != priorityDefault:
+		return class
+	case dc.isRelease(branch):
+		return priorityRelease
+	}
+	return priorityDefault
+}
+
+// dispatchItem is a build waiting to be sent to jenkins.
+type dispatchItem struct {
+	Repo     string    `json:"repo"`
+	PR       int       `json:"pr,omitempty"`
+	Sha      string    `json:"sha"`
+	Branch   string    `json:"branch,omitempty"`
+	Job      string    `json:"job"`
+	Jenkins  string    `json:"jenkins,omitempty"`
+	Class    string    `json:"class"`
+	Priority int       `json:"priority"`
+	Queued   time.Time `json:"queued"`
+
+	// start sends the build to jenkins and tracks it.
+	start func(ctx context.Context) error
+}
+
+// dispatchQueue holds the builds waiting to be sent to jenkins.
+type dispatchQueue struct {
+	mu    sync.Mutex
+	items []*dispatchItem
+	kick  chan struct{}
+}
+
+var dispatcher = &dispatchQueue{kick: make(chan struct{}, 1)}
+
+// dispatch sends a build to jenkins right away if there are no limits, or
+// queues it until it fits under them.
+func (c Config) dispatch(ctx context.Context, item dispatchItem) error {
+	if c.Dispatch == nil {
+		return item.start(ctx)
+	}
+
+	item.Class = c.Dispatch.priorityClass(ctx, item.Branch)
+	item.Priority = c.Dispatch.priority(item.Class)
+	item.Queued = time.Now()
+	dispatcher.add(&item)
+	logrus.Infof("Queued job %s for %s at %s with priority class %s", item.Job, item.Repo, item.Sha, item.Class)
+
+	dispatcher.wake()
+	return nil
+}
+
+// add queues a build, replacing the queued build of the same job for the same
+// pull request or commit.
+func (d *dispatchQueue) add(item *dispatchItem) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	items := d.items[:0]
+	for _, i := range d.items {
+		if i.Repo == item.Repo && i.Job == item.Job && i.Jenkins == item.Jenkins &&
+			((item.PR != 0 && i.PR == item.PR) || i.Sha == item.Sha) {
+			continue
+		}
+		items = append(items, i)
+	}
+	d.items = append(items, item)
+}
+
+// cancel drops the queued builds of a job on a jenkins master for a pull
+// request.
+func (d *dispatchQueue) cancel(repo string, pr int, jenkins, job string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	items := d.items[:0]
+	for _, i := range d.items {
+		if i.Repo == repo && i.PR == pr && i.Jenkins == jenkins && i.Job == job {
+			logrus.Infof("Dropped queued job %s for %s#%d", job, repo, pr)
+			continue
+		}
+		items = append(items, i)
+	}
+	d.items = items
+}
+
+// wake makes the dispatcher check the queue.
+func (d *dispatchQueue) wake() {
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run dispatches the queued builds when they fit under the limits.
+func (d *dispatchQueue) run(c Config) {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.kick:
+		case <-ticker.C:
+		}
+
+		for _, item := range d.next(*c.Dispatch) {
+			if err := item.start(context.Background()); err != nil {
+				logrus.Errorf("dispatching job %s for %s at %s failed: %v", item.Job, item.Repo, item.Sha, err)
+			}
+		}
+	}
+}
+
+// next removes the queued builds that fit under the limits from the queue
+// and returns them, ordered by priority and then by the number of builds
+// their repository runs, so repositories get a fair share of jenkins.
+func (d *dispatchQueue) next(dc DispatchConfig) (next []*dispatchItem) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// count the builds jenkins is running or has queued, jobs by master
+	repos, jobs := map[string]int{}, map[string]int{}
+	for _, b := range tracker.pending() {
+		repos[b.Repo]++
+		jobs[jobKey(b.Jenkins, b.Job)]++
+	}
+
+	for {
+		var best *dispatchItem
+		for _, i := range d.items {
+			if l := dc.repoLimit(i.Repo); l > 0 && repos[i.Repo] >= l {
+				continue
+			}
+			if l := dc.jobLimit(i.Jenkins, i.Job); l > 0 && jobs[jobKey(i.Jenkins, i.Job)] >= l {
+				continue
+			}
+			if best == nil || i.Priority < best.Priority ||
+				(i.Priority == best.Priority && repos[i.Repo] < repos[best.Repo]) ||
+				(i.Priority == best.Priority && repos[i.Repo] == repos[best.Repo] && i.Queued.Before(best.Queued)) {
+				best = i
+			}
+		}
+		if best == nil {
+			return next
+		}
+
+		next = append(next, best)
+		repos[best.Repo]++
+		jobs[jobKey(best.Jenkins, best.Job)]++
+
+		items := d.items[:0]
+		for _, i := range d.items {
+			if i != best {
+				items = append(items, i)
+			}
+		}
+		d.items = items
+	}
+}
+
+// list returns the queued builds in the order they are dispatched if the
+// limits allowed it.
+func (d *dispatchQueue) list() []dispatchItem {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	items := []dispatchItem{}
+	for _, i := range d.items {
+		items = append(items, *i)
+	}
+	sort.SliceStable(items, func(a, b int) bool {
+		if items[a].Priority != items[b].Priority {
+			return items[a].Priority < items[b].Priority
+		}
+		return items[a].Queued.Before(items[b].Queued)
+	})
+	return items
+}
+
+func dispatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		logrus.Errorf("%q is not a valid method", r.Method)
+		w.WriteHeader(405)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dispatcher.list()); err != nil {
+		logrus.Errorf("encoding the dispatch queue as json failed: %v", err)
+	}
+}
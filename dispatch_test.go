@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDispatchQueueNextJobLimits(t *testing.T) {
+	defer func(t *buildTracker) { tracker = t }(tracker)
+	tracker = newBuildTracker()
+	tracker.add(trackedBuild{Repo: "docker/docker", Sha: "a", Job: "Docker-PRs", State: "pending"})
+	tracker.add(trackedBuild{Repo: "docker/docker", Sha: "a", Jenkins: "windows", Job: "Docker-PRs", State: "pending"})
+
+	dc := DispatchConfig{JobLimits: map[string]int{"Docker-PRs": 2, "windows/Docker-PRs": 1}}
+	d := &dispatchQueue{}
+	now := time.Now()
+	d.add(&dispatchItem{Repo: "docker/docker", Sha: "b", Job: "Docker-PRs", Queued: now})
+	d.add(&dispatchItem{Repo: "docker/docker", Sha: "c", Job: "Docker-PRs", Queued: now.Add(time.Second)})
+	d.add(&dispatchItem{Repo: "docker/docker", PR: 5, Sha: "b", Jenkins: "windows", Job: "Docker-PRs", Queued: now})
+
+	// the default master runs one of two builds, the windows master is full
+	next := d.next(dc)
+	if len(next) != 1 || next[0].Sha != "b" || next[0].Jenkins != "" {
+		t.Fatalf("expected only b to be dispatched to the default master, was %#v", next)
+	}
+	if items := d.list(); len(items) != 2 {
+		t.Fatalf("expected 2 builds to stay queued, was %#v", items)
+	}
+
+	// only the build on the windows master is cancelled
+	d.cancel("docker/docker", 5, "", "Docker-PRs")
+	if items := d.list(); len(items) != 2 {
+		t.Fatalf("expected 2 builds to stay queued, was %#v", items)
+	}
+	d.cancel("docker/docker", 5, "windows", "Docker-PRs")
+	if items := d.list(); len(items) != 1 || items[0].Sha != "c" {
+		t.Fatalf("expected only c to stay queued, was %#v", items)
+	}
+}
+
+func TestDispatchQueueNextPriority(t *testing.T) {
+	defer func(t *buildTracker) { tracker = t }(tracker)
+	tracker = newBuildTracker()
+	tracker.add(trackedBuild{Repo: "docker/docker", Sha: "a", Job: "Docker-PRs", State: "pending"})
+
+	dc := DispatchConfig{}
+	d := &dispatchQueue{}
+	now := time.Now()
+	d.add(&dispatchItem{Repo: "docker/docker", Sha: "b", Job: "Docker-PRs", Priority: dc.priority(priorityCron), Queued: now})
+	d.add(&dispatchItem{Repo: "docker/docker", Sha: "c", Job: "Docker-PRs", Priority: dc.priority(priorityDefault), Queued: now})
+	d.add(&dispatchItem{Repo: "docker/cli", Sha: "d", Job: "CLI-PRs", Priority: dc.priority(priorityDefault), Queued: now.Add(time.Second)})
+
+	// the repository running fewer builds goes first within a class
+	var shas string
+	for _, i := range d.next(dc) {
+		shas += i.Sha
+	}
+	if shas != "dcb" {
+		t.Fatalf("expected the builds to be dispatched in the order dcb, was %s", shas)
+	}
+}
+
+func TestPriorityClass(t *testing.T) {
+	dc := DispatchConfig{ReleaseBranches: []string{"release/*"}}
+
+	if class := dc.priorityClass(context.Background(), "master"); class != priorityDefault {
+		t.Fatalf("expected the default class, was %s", class)
+	}
+	if class := dc.priorityClass(context.Background(), "release/1.13"); class != priorityRelease {
+		t.Fatalf("expected the release class, was %s", class)
+	}
+	ctx := withPriority(withPriority(context.Background(), priorityRetry), priorityCron)
+	if class := dc.priorityClass(ctx, "release/1.13"); class != priorityRetry {
+		t.Fatalf("expected the class of the context to be kept, was %s", class)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/crosbymichael/octokat"
+	"github.com/docker/leeroy/github"
+)
+
+const (
+	// draftBuild builds draft and work in progress pull requests like any
+	// other. It is the default.
+	draftBuild = "build"
+	// draftSkip does not build draft and work in progress pull requests.
+	draftSkip = "skip"
+	// draftDefer does not build draft and work in progress pull requests,
+	// but sets a pending status saying the build is deferred.
+	draftDefer = "defer"
+
+	// defaultDeferredDescription is the description of the status of
+	// deferred builds if the config does not say otherwise.
+	defaultDeferredDescription = "Build deferred until ready for review"
+)
+
+// isWIP returns if a pull request title marks it as work in progress.
+func (rc RepoConfig) isWIP(title string) bool {
+	title = strings.ToLower(strings.TrimSpace(title))
+	for _, prefix := range rc.WIPPrefixes {
+		if strings.HasPrefix(title, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// holdsBuild returns if the build of a draft or work in progress pull request
+// is skipped or deferred.
+func (rc RepoConfig) holdsBuild(draft bool, title string) bool {
+	if rc.DraftPolicy == "" || rc.DraftPolicy == draftBuild {
+		return false
+	}
+
+	return draft || rc.isWIP(title)
+}
+
+// holdPRBuilds checks if the builds of a pull request scheduled without its
+// webhook, like rebuilds, are held because it is a draft or work in progress,
+// and defers them if so.
+func (c Config) holdPRBuilds(baseRepo string, number int) (bool, error) {
+	rc := c.getRepoConfig(baseRepo)
+	if rc.DraftPolicy == "" || rc.DraftPolicy == draftBuild {
+		return false, nil
+	}
+
+	r := strings.SplitN(baseRepo, "/", 2)
+	if len(r) < 2 {
+		return false, fmt.Errorf("repo name could not be parsed: %s", baseRepo)
+	}
+
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	pr, err := g.GetPullRequestDetails(repo, number)
+	if err != nil {
+		return false, fmt.Errorf("getting pull request %s#%d failed: %v", baseRepo, number, err)
+	}
+	if !rc.holdsBuild(pr.Draft, pr.Title) {
+		return false, nil
+	}
+
+	return true, c.deferPRBuilds(baseRepo, number, pr.Head.Sha)
+}
+
+// deferPRBuilds sets the status of the builds of a draft or work in progress
+// pull request to say they are deferred, if the policy of the repository
+// asks for it.
+func (c Config) deferPRBuilds(baseRepo string, number int, sha string) error {
+	rc := c.getRepoConfig(baseRepo)
+	if rc.DraftPolicy != draftDefer {
+		logrus.Infof("Not building draft or work in progress PR %s#%d", baseRepo, number)
+		return nil
+	}
+
+	builds, err := c.getBuilds(baseRepo, false, false)
+	if err != nil {
+		return err
+	}
+
+	desc := rc.DeferredDescription
+	if desc == "" {
+		desc = defaultDeferredDescription
+	}
+	url := fmt.Sprintf("https://github.com/%s/pull/%d", baseRepo, number)
+	for _, build := range builds {
+		if build.Job == "" {
+			continue
+		}
+		if err := c.updateGithubStatus(baseRepo, build.Context, sha, "pending", desc, url); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Deferred building draft or work in progress PR %s#%d", baseRepo, number)
+	return nil
+}
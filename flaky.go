@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/leeroy/jenkins"
+)
+
+// testOutcome records if a test passed and failed on a commit.
+type testOutcome struct {
+	Passed  bool
+	Failed  bool
+	Updated time.Time
+}
+
+// flakyTest describes a test that both failed and passed on the same commit.
+type flakyTest struct {
+	Job      string    `json:"job"`
+	Jenkins  string    `json:"jenkins,omitempty"`
+	Test     string    `json:"test"`
+	Flakes   int       `json:"flakes"`
+	LastSha  string    `json:"last_sha"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// testHistory keeps the outcomes of the tests of each job per commit, to find
+// the tests that are flaky.
+type testHistory struct {
+	mu       sync.Mutex
+	outcomes map[string]map[string]map[string]*testOutcome // master/job -> sha -> test -> outcome
+	flaky    map[string]map[string]*flakyTest              // master/job -> test -> flakes
+	retried  map[string]time.Time                          // master/job and sha -> time of the retry
+}
+
+var history = newTestHistory()
+
+func newTestHistory() *testHistory {
+	return &testHistory{
+		outcomes: map[string]map[string]map[string]*testOutcome{},
+		flaky:    map[string]map[string]*flakyTest{},
+		retried:  map[string]time.Time{},
+	}
+}
+
+// record adds the outcomes of a build of a job on a jenkins master for a
+// commit. If the build succeeded, the tests that failed before on the commit
+// are considered to have passed.
+func (h *testHistory) record(jenkins, job, sha string, succeeded bool, passed, failed []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.prune()
+
+	key := jobKey(jenkins, job)
+	if h.outcomes[key] == nil {
+		h.outcomes[key] = map[string]map[string]*testOutcome{}
+	}
+	tests := h.outcomes[key][sha]
+	if tests == nil {
+		tests = map[string]*testOutcome{}
+		h.outcomes[key][sha] = tests
+	}
+
+	if succeeded {
+		for name := range tests {
+			passed = append(passed, name)
+		}
+	}
+
+	outcome := func(name string) *testOutcome {
+		o := tests[name]
+		if o == nil {
+			o = &testOutcome{}
+			tests[name] = o
+		}
+		o.Updated = time.Now()
+		return o
+	}
+	for _, name := range passed {
+		h.update(jenkins, job, sha, name, outcome(name), true)
+	}
+	for _, name := range failed {
+		h.update(jenkins, job, sha, name, outcome(name), false)
+	}
+}
+
+// update records a single outcome of a test and counts it as a flake the
+// first time the test both passed and failed on the commit. The caller must
+// hold the lock.
+func (h *testHistory) update(jenkins, job, sha, name string, o *testOutcome, passed bool) {
+	wasFlaky := o.Passed && o.Failed
+	if passed {
+		o.Passed = true
+	} else {
+		o.Failed = true
+	}
+	if wasFlaky || !o.Passed || !o.Failed {
+		return
+	}
+
+	key := jobKey(jenkins, job)
+	if h.flaky[key] == nil {
+		h.flaky[key] = map[string]*flakyTest{}
+	}
+	f := h.flaky[key][name]
+	if f == nil {
+		f = &flakyTest{Job: job, Jenkins: jenkins, Test: name}
+		h.flaky[key][name] = f
+	}
+	f.Flakes++
+	f.LastSha = sha
+	f.LastSeen = time.Now()
+
+	logrus.Infof("Test %s of job %s is flaky, it failed and passed on %s", name, job, sha)
+}
+
+// allFlaky returns if every test in failed is known to be flaky for the job
+// on the jenkins master.
+func (h *testHistory) allFlaky(jenkins, job string, failed []string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(failed) == 0 {
+		return false
+	}
+	for _, name := range failed {
+		if h.flaky[jobKey(jenkins, job)][name] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// retry returns if a build of the job on the jenkins master for the commit
+// may be retried, and records that it was.
+func (h *testHistory) retry(jenkins, job, sha string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := jobKey(jenkins, job) + "@" + sha
+	if _, ok := h.retried[key]; ok {
+		return false
+	}
+	h.retried[key] = time.Now()
+	return true
+}
+
+// leaderboard returns the flaky tests ordered by the number of flakes. If job
+// is not empty only the tests of that job, on any jenkins master, are
+// returned.
+func (h *testHistory) leaderboard(job string) []flakyTest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	tests := []flakyTest{}
+	for _, flaky := range h.flaky {
+		for _, f := range flaky {
+			if job != "" && f.Job != job {
+				continue
+			}
+			tests = append(tests, *f)
+		}
+	}
+
+	sort.Slice(tests, func(i, j int) bool {
+		if tests[i].Flakes != tests[j].Flakes {
+			return tests[i].Flakes > tests[j].Flakes
+		}
+		return tests[i].LastSeen.After(tests[j].LastSeen)
+	})
+	return tests
+}
+
+// prune drops the outcomes and retries of commits that were not built for
+// longer than the retention period. The caller must hold the lock.
+func (h *testHistory) prune() {
+	cutoff := time.Now().Add(-trackerRetention)
+	for job, shas := range h.outcomes {
+		for sha, tests := range shas {
+			var recent bool
+			for _, o := range tests {
+				if o.Updated.After(cutoff) {
+					recent = true
+					break
+				}
+			}
+			if !recent {
+				delete(shas, sha)
+			}
+		}
+		if len(shas) == 0 {
+			delete(h.outcomes, job)
+		}
+	}
+	for key, t := range h.retried {
+		if t.Before(cutoff) {
+			delete(h.retried, key)
+		}
+	}
+}
+
+// recordTestResults adds the outcomes of the tests of a completed build to
+// the history and returns the names of the tests that failed. The outcomes
+// come from the test report if there is one, otherwise the failed tests are
+// found in the log using the test name pattern of the build.
+func (c Config) recordTestResults(ctx context.Context, j jenkins.Response, build Build, state string, report *jenkins.TestReport) []string {
+	var passed, failed []string
+	switch {
+	case report != nil:
+		for _, s := range report.Suites {
+			for _, tc := range s.Cases {
+				if tc.Passed() {
+					passed = append(passed, tc.FullName())
+				} else if tc.Failed() {
+					failed = append(failed, tc.FullName())
+				}
+			}
+		}
+	case state == "success":
+		// every test passed, which is recorded for the tests that failed
+		// before on the commit
+	case state == "failure" && build.TestNamePattern != "":
+		jc, err := c.getJenkins(build.Jenkins)
+		if err != nil {
+			logrus.Error(err)
+			return nil
+		}
+		failed, err = jc.GetFailedTests(ctx, j.Name, j.Build.Number, build.TestNamePattern, build.LogTail)
+		if err != nil {
+			logrus.Warnf("finding failed tests in log for job %s and build %d failed: %v", j.Name, j.Build.Number, err)
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	history.record(build.Jenkins, j.Name, j.Build.Parameters.GitSha, state == "success", passed, failed)
+	return failed
+}
+
+// retryFlakyBuild reschedules a failed build of a pull request once per
+// commit if all the tests that failed are known to be flaky. It returns if
+// the build was rescheduled.
+func (c Config) retryFlakyBuild(ctx context.Context, j jenkins.Response, build Build, failed []string) bool {
+	if !build.RetryFlaky || j.Build.Parameters.PR == "" || !history.allFlaky(build.Jenkins, j.Name, failed) {
+		return false
+	}
+
+	number, err := strconv.Atoi(j.Build.Parameters.PR)
+	if err != nil {
+		logrus.Errorf("parsing PR %q of build %s %d failed: %v", j.Build.Parameters.PR, j.Name, j.Build.Number, err)
+		return false
+	}
+
+	if !history.retry(build.Jenkins, j.Name, j.Build.Parameters.GitSha) {
+		logrus.Infof("Not retrying build %s %d for %s again", j.Name, j.Build.Number, j.Build.Parameters.GitSha)
+		return false
+	}
+
+	logrus.Infof("Retrying build %s %d for %s#%d, all failed tests are flaky: %v", j.Name, j.Build.Number, j.Build.Parameters.GitBaseRepo, number, failed)
+	if err := c.scheduleJenkinsBuild(withPriority(ctx, priorityRetry), j.Build.Parameters.GitBaseRepo, number, "", build); err != nil {
+		logrus.Error(err)
+		return false
+	}
+
+	return true
+}
+
+func flakyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		logrus.Errorf("%q is not a valid method", r.Method)
+		w.WriteHeader(405)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history.leaderboard(r.URL.Query().Get("job"))); err != nil {
+		logrus.Errorf("encoding the flaky tests as json failed: %v", err)
+	}
+}
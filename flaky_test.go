@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestTestHistoryFlaky(t *testing.T) {
+	h := newTestHistory()
+
+	h.record("", "Docker-PRs", "abc", false, []string{"TestPass"}, []string{"TestFlaky", "TestBroken"})
+	if h.allFlaky("", "Docker-PRs", []string{"TestFlaky"}) {
+		t.Fatal("expected a test that only failed not to be flaky")
+	}
+
+	// a successful build on the same commit means the failed tests passed
+	h.record("", "Docker-PRs", "abc", true, nil, nil)
+	h.record("", "Docker-PRs", "def", false, []string{"TestFlaky"}, []string{"TestBroken"})
+
+	if !h.allFlaky("", "Docker-PRs", []string{"TestFlaky", "TestBroken"}) {
+		t.Fatal("expected tests that failed and passed on the same commit to be flaky")
+	}
+	if h.allFlaky("", "Docker-PRs", []string{"TestPass"}) || h.allFlaky("", "Docker-PRs", nil) {
+		t.Fatal("expected tests that never failed not to be flaky")
+	}
+	if h.allFlaky("", "Other-PRs", []string{"TestFlaky"}) {
+		t.Fatal("expected flaky tests to be tracked per job")
+	}
+
+	board := h.leaderboard("")
+	if len(board) != 2 {
+		t.Fatalf("expected 2 flaky tests, was %d: %#v", len(board), board)
+	}
+	for _, f := range board {
+		if f.Flakes != 1 || f.LastSha != "abc" {
+			t.Fatalf("expected one flake on abc, was: %#v", f)
+		}
+	}
+
+	if !h.retry("", "Docker-PRs", "abc") || h.retry("", "Docker-PRs", "abc") {
+		t.Fatal("expected a build to be retried only once per commit")
+	}
+	if !h.retry("windows", "Docker-PRs", "abc") {
+		t.Fatal("expected a build of the job on another master to be retried")
+	}
+}
+
+func TestTestHistoryMasters(t *testing.T) {
+	h := newTestHistory()
+
+	h.record("", "Docker-PRs", "abc", false, nil, []string{"TestFlaky"})
+	h.record("windows", "Docker-PRs", "abc", true, []string{"TestFlaky"}, nil)
+	if h.allFlaky("", "Docker-PRs", []string{"TestFlaky"}) || h.allFlaky("windows", "Docker-PRs", []string{"TestFlaky"}) {
+		t.Fatal("expected the outcomes of the job on two masters not to be mixed")
+	}
+
+	h.record("windows", "Docker-PRs", "def", false, nil, []string{"TestFlaky"})
+	h.record("windows", "Docker-PRs", "def", true, nil, nil)
+	if board := h.leaderboard("Docker-PRs"); len(board) != 1 || board[0].Jenkins != "windows" {
+		t.Fatalf("expected the flaky test of the windows master, was %#v", board)
+	}
+}
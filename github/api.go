@@ -0,0 +1,185 @@
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/crosbymichael/octokat"
+)
+
+const (
+	// apiURL is the url of the GitHub API.
+	apiURL = "https://api.github.com"
+
+	// apiTimeout is the timeout for requests to the GitHub API octokat does
+	// not support.
+	apiTimeout = 30 * time.Second
+)
+
+var apiClient = &http.Client{Timeout: apiTimeout}
+
+// PullRequestDetails holds the fields of a pull request octokat does not
+// know about.
+type PullRequestDetails struct {
+	Number            int             `json:"number"`
+	Title             string          `json:"title"`
+	State             string          `json:"state"`
+	Draft             bool            `json:"draft"`
+	MergeCommitSha    string          `json:"merge_commit_sha"`
+	Mergeable         *bool           `json:"mergeable"`
+	MergeableState    string          `json:"mergeable_state"`
+	AuthorAssociation string          `json:"author_association"`
+	Labels            []octokat.Label `json:"labels"`
+	Head              octokat.Commit  `json:"head"`
+	Base              octokat.Commit  `json:"base"`
+}
+
+// HasLabel returns if the pull request has the label.
+func (pr PullRequestDetails) HasLabel(label string) bool {
+	for _, l := range pr.Labels {
+		if l.Name == label {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetPullRequestDetails returns the fields of a pull request octokat does not
+// know about.
+func (g GitHub) GetPullRequestDetails(repo octokat.Repo, number int) (*PullRequestDetails, error) {
+	var pr PullRequestDetails
+	path := fmt.Sprintf("/repos/%s/%s/pulls/%d", repo.UserName, repo.Name, number)
+	if err := g.request("GET", path, nil, &pr); err != nil {
+		return nil, err
+	}
+
+	return &pr, nil
+}
+
+// APIError is returned when the GitHub API responds with an error status.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("github %s %s responded with status %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// isStatus returns if err is an APIError with the status code.
+func isStatus(err error, code int) bool {
+	e, ok := err.(*APIError)
+	return ok && e.StatusCode == code
+}
+
+// request sends a request to the GitHub API, encoding in as the body if it is
+// not nil and decoding the response into out if it is not nil.
+func (g GitHub) request(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, apiURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", "token "+g.AuthToken)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return &APIError{Method: method, Path: path, StatusCode: resp.StatusCode, Message: e.Message}
+	}
+
+	if out == nil || resp.StatusCode == 204 {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding json response from github %s %s failed: %v", method, path, err)
+	}
+
+	return nil
+}
+
+// ErrNotMergeable is returned when GitHub cannot create a test merge commit
+// for a pull request because it conflicts with its base branch.
+var ErrNotMergeable = errors.New("pull request is not mergeable")
+
+// TestMergeCommit is the commit GitHub creates to test merging the head of a
+// pull request into its base branch, at refs/pull/N/merge.
+type TestMergeCommit struct {
+	Sha     string
+	BaseSha string
+	HeadSha string
+}
+
+// WaitForTestMergeCommit returns the test merge commit for the head of a pull
+// request. GitHub computes it in the background after the pull request or
+// its base branch changed, so it is requested up to attempts times, doubling
+// the delay in between.
+func (g GitHub) WaitForTestMergeCommit(repo octokat.Repo, number int, head string, attempts int, delay time.Duration) (*TestMergeCommit, error) {
+	for attempt := 1; ; attempt++ {
+		pr, err := g.GetPullRequestDetails(repo, number)
+		if err != nil {
+			return nil, err
+		}
+		if pr.Head.Sha != head {
+			return nil, fmt.Errorf("head of pull request %d moved from %s to %s", number, head, pr.Head.Sha)
+		}
+		if pr.Mergeable != nil && !*pr.Mergeable {
+			return nil, ErrNotMergeable
+		}
+
+		if pr.Mergeable != nil && pr.MergeCommitSha != "" {
+			var commit struct {
+				Parents []struct {
+					Sha string `json:"sha"`
+				} `json:"parents"`
+			}
+			path := fmt.Sprintf("/repos/%s/%s/commits/%s", repo.UserName, repo.Name, pr.MergeCommitSha)
+			if err := g.request("GET", path, nil, &commit); err != nil {
+				return nil, err
+			}
+
+			// the merge commit may still be the one of an earlier head
+			if len(commit.Parents) == 2 && commit.Parents[1].Sha == head {
+				return &TestMergeCommit{
+					Sha:     pr.MergeCommitSha,
+					BaseSha: commit.Parents[0].Sha,
+					HeadSha: head,
+				}, nil
+			}
+		}
+
+		if attempt >= attempts {
+			return nil, fmt.Errorf("github did not create a test merge commit for %s of pull request %d after %d attempts", head, number, attempts)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,85 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/crosbymichael/octokat"
+)
+
+// ErrMergeConflict is returned when a commit cannot be merged into a branch
+// because they conflict.
+var ErrMergeConflict = errors.New("merge conflict")
+
+type gitRef struct {
+	Ref    string `json:"ref"`
+	Object struct {
+		Sha string `json:"sha"`
+	} `json:"object"`
+}
+
+// BranchSha returns the commit at the tip of a branch.
+func (g GitHub) BranchSha(repo octokat.Repo, branch string) (string, error) {
+	var ref gitRef
+	path := fmt.Sprintf("/repos/%s/%s/git/ref/heads/%s", repo.UserName, repo.Name, branch)
+	if err := g.request("GET", path, nil, &ref); err != nil {
+		return "", err
+	}
+
+	return ref.Object.Sha, nil
+}
+
+// UpdateBranch points a branch at a commit, creating the branch if it does
+// not exist. Unless force is set the commit has to be a descendant of the
+// tip of the branch.
+func (g GitHub) UpdateBranch(repo octokat.Repo, branch, sha string, force bool) error {
+	in := map[string]interface{}{
+		"sha":   sha,
+		"force": force,
+	}
+	path := fmt.Sprintf("/repos/%s/%s/git/refs/heads/%s", repo.UserName, repo.Name, branch)
+	err := g.request("PATCH", path, in, nil)
+	if err == nil || (!isStatus(err, 422) && !isStatus(err, 404)) {
+		return err
+	}
+
+	// github responds like this if the branch does not exist, but also if
+	// the update is not a fast forward
+	if _, getErr := g.BranchSha(repo, branch); !isStatus(getErr, 404) {
+		return err
+	}
+
+	in = map[string]interface{}{
+		"ref": "refs/heads/" + branch,
+		"sha": sha,
+	}
+	path = fmt.Sprintf("/repos/%s/%s/git/refs", repo.UserName, repo.Name)
+	return g.request("POST", path, in, nil)
+}
+
+// MergeIntoBranch merges a commit into a branch and returns the merge
+// commit. It returns ErrMergeConflict if they conflict, and the tip of the
+// branch if it already contains the commit.
+func (g GitHub) MergeIntoBranch(repo octokat.Repo, branch, head, message string) (string, error) {
+	in := map[string]string{
+		"base":           branch,
+		"head":           head,
+		"commit_message": message,
+	}
+	var commit struct {
+		Sha string `json:"sha"`
+	}
+	path := fmt.Sprintf("/repos/%s/%s/merges", repo.UserName, repo.Name)
+	if err := g.request("POST", path, in, &commit); err != nil {
+		if isStatus(err, 409) {
+			return "", ErrMergeConflict
+		}
+		return "", err
+	}
+
+	// nothing was merged
+	if commit.Sha == "" {
+		return g.BranchSha(repo, branch)
+	}
+	return commit.Sha, nil
+}
@@ -0,0 +1,62 @@
+package github
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/crosbymichael/octokat"
+)
+
+// IssueCommentHook describes the hook for a comment on an issue or pull
+// request
+type IssueCommentHook struct {
+	Action  string         `json:"action"`
+	Issue   HookIssue      `json:"issue"`
+	Comment HookComment    `json:"comment"`
+	Repo    HookRepository `json:"repository"`
+}
+
+// HookIssue describes the issue or pull request of a hook
+type HookIssue struct {
+	Number      int    `json:"number"`
+	State       string `json:"state"`
+	PullRequest *struct {
+		URL string `json:"url"`
+	} `json:"pull_request"`
+}
+
+// HookComment describes the comment of a hook
+type HookComment struct {
+	ID                int          `json:"id"`
+	Body              string       `json:"body"`
+	AuthorAssociation string       `json:"author_association"`
+	User              octokat.User `json:"user"`
+}
+
+// IsPullRequest returns if the comment is on a pull request
+func (h IssueCommentHook) IsPullRequest() bool {
+	return h.Issue.PullRequest != nil
+}
+
+// HasCommand returns if a line of the comment is the command, like
+// "/ok-to-test".
+func (h IssueCommentHook) HasCommand(command string) bool {
+	for _, line := range strings.Split(h.Comment.Body, "\n") {
+		if strings.TrimSpace(line) == command {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseIssueCommentHook parses the web hook recieved into an IssueCommentHook
+func ParseIssueCommentHook(body io.Reader) (IssueCommentHook, error) {
+	h := IssueCommentHook{}
+	if err := json.NewDecoder(body).Decode(&h); err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,33 @@
+package github
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseIssueCommentHook(t *testing.T) {
+	body := `{
+		"action": "created",
+		"issue": {"number": 42, "state": "open", "pull_request": {"url": "https://api.github.com/repos/docker/docker/pulls/42"}},
+		"comment": {"id": 1, "body": "Looks safe.\r\n/ok-to-test\r\n", "author_association": "MEMBER", "user": {"login": "jfrazelle"}},
+		"repository": {"full_name": "docker/docker"}
+	}`
+
+	h, err := ParseIssueCommentHook(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !h.IsPullRequest() || h.Issue.Number != 42 || h.Repo.FullName != "docker/docker" {
+		t.Fatalf("unexpected hook %+v", h)
+	}
+	if h.Comment.AuthorAssociation != "MEMBER" || h.Comment.User.Login != "jfrazelle" {
+		t.Fatalf("unexpected comment %+v", h.Comment)
+	}
+	if !h.HasCommand("/ok-to-test") {
+		t.Fatal("expected the comment to have the /ok-to-test command")
+	}
+	if h.HasCommand("/merge") {
+		t.Fatal("expected the comment not to have the /merge command")
+	}
+}
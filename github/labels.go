@@ -97,3 +97,13 @@ func (g GitHub) labelExist(repo octokat.Repo, issueNum int, label string) (bool,
 
 	return false, nil
 }
+
+// RemoveLabel removes a label from an issue or pull request, if it has it.
+func (g GitHub) RemoveLabel(repo octokat.Repo, issueNum int, label string) error {
+	return g.removeLabel(repo, issueNum, label)
+}
+
+// AddLabel adds a label to an issue or pull request, if it does not have it.
+func (g GitHub) AddLabel(repo octokat.Repo, issueNum int, label string) error {
+	return g.addLabel(repo, issueNum, label)
+}
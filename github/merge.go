@@ -0,0 +1,57 @@
+package github
+
+import (
+	"fmt"
+
+	"github.com/crosbymichael/octokat"
+)
+
+// Review describes a review of a pull request
+type Review struct {
+	ID    int          `json:"id"`
+	User  octokat.User `json:"user"`
+	State string       `json:"state"`
+}
+
+// ApprovingReviews returns the number of users whose latest review of a
+// pull request approves it. Comments do not change an earlier review.
+func (g GitHub) ApprovingReviews(repo octokat.Repo, number int) (int, error) {
+	var reviews []Review
+	path := fmt.Sprintf("/repos/%s/%s/pulls/%d/reviews?per_page=100", repo.UserName, repo.Name, number)
+	if err := g.request("GET", path, nil, &reviews); err != nil {
+		return 0, err
+	}
+
+	return countApprovals(reviews), nil
+}
+
+// countApprovals returns the number of users whose latest review approves,
+// of reviews ordered from oldest to newest.
+func countApprovals(reviews []Review) int {
+	latest := map[string]string{}
+	for _, r := range reviews {
+		switch r.State {
+		case "APPROVED", "CHANGES_REQUESTED", "DISMISSED":
+			latest[r.User.Login] = r.State
+		}
+	}
+
+	var approvals int
+	for _, state := range latest {
+		if state == "APPROVED" {
+			approvals++
+		}
+	}
+	return approvals
+}
+
+// MergePullRequest merges a pull request with the method, "merge", "squash"
+// or "rebase", if its head is still sha.
+func (g GitHub) MergePullRequest(repo octokat.Repo, number int, sha, method string) error {
+	in := map[string]string{
+		"sha":          sha,
+		"merge_method": method,
+	}
+	path := fmt.Sprintf("/repos/%s/%s/pulls/%d/merge", repo.UserName, repo.Name, number)
+	return g.request("PUT", path, in, nil)
+}
@@ -0,0 +1,33 @@
+package github
+
+import (
+	"testing"
+
+	"github.com/crosbymichael/octokat"
+)
+
+func TestCountApprovals(t *testing.T) {
+	review := func(login, state string) Review {
+		return Review{User: octokat.User{Login: login}, State: state}
+	}
+
+	cases := []struct {
+		reviews  []Review
+		expected int
+	}{
+		{nil, 0},
+		{[]Review{review("a", "APPROVED"), review("b", "APPROVED")}, 2},
+		// a comment does not undo an approval
+		{[]Review{review("a", "APPROVED"), review("a", "COMMENTED")}, 1},
+		// the latest review of a user counts
+		{[]Review{review("a", "APPROVED"), review("a", "CHANGES_REQUESTED")}, 0},
+		{[]Review{review("a", "CHANGES_REQUESTED"), review("a", "APPROVED")}, 1},
+		{[]Review{review("a", "APPROVED"), review("a", "DISMISSED"), review("b", "APPROVED")}, 1},
+	}
+
+	for i, c := range cases {
+		if n := countApprovals(c.reviews); n != c.expected {
+			t.Fatalf("case %d: expected %d approvals, was %d", i, c.expected, n)
+		}
+	}
+}
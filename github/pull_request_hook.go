@@ -0,0 +1,44 @@
+package github
+
+import (
+	"encoding/json"
+
+	"github.com/crosbymichael/octokat"
+)
+
+// PullRequestHookDetails holds the fields of a pull request hook octokat does
+// not know about
+type PullRequestHookDetails struct {
+	Action      string             `json:"action"`
+	PullRequest PullRequestDetails `json:"pull_request"`
+	Changes     HookChanges        `json:"changes"`
+	Label       *octokat.Label     `json:"label"`
+	Sender      *octokat.User      `json:"sender"`
+	Repo        HookRepository     `json:"repository"`
+}
+
+// HookChanges describes what an edited hook changed
+type HookChanges struct {
+	Title *struct {
+		From string `json:"from"`
+	} `json:"title"`
+}
+
+// TitleChanged returns if the hook changed the title, and what it was before.
+func (h PullRequestHookDetails) TitleChanged() (string, bool) {
+	if h.Changes.Title == nil {
+		return "", false
+	}
+	return h.Changes.Title.From, true
+}
+
+// ParsePullRequestHookDetails parses the web hook recieved into a
+// PullRequestHookDetails
+func ParsePullRequestHookDetails(body []byte) (PullRequestHookDetails, error) {
+	h := PullRequestHookDetails{}
+	if err := json.Unmarshal(body, &h); err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,32 @@
+package github
+
+import "testing"
+
+func TestParsePullRequestHookDetails(t *testing.T) {
+	body := `{
+		"action": "edited",
+		"changes": {"title": {"from": "WIP: fix the daemon"}},
+		"pull_request": {"number": 42, "state": "open", "draft": true}
+	}`
+
+	h, err := ParsePullRequestHookDetails([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Action != "edited" || h.PullRequest.Number != 42 || !h.PullRequest.Draft {
+		t.Fatalf("unexpected hook %+v", h)
+	}
+	from, ok := h.TitleChanged()
+	if !ok || from != "WIP: fix the daemon" {
+		t.Fatalf("expected the title to change from %q, was %q (%v)", "WIP: fix the daemon", from, ok)
+	}
+
+	h, err = ParsePullRequestHookDetails([]byte(`{"action": "edited", "changes": {"body": {"from": ""}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.TitleChanged(); ok {
+		t.Fatal("expected the title not to change")
+	}
+}
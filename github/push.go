@@ -0,0 +1,113 @@
+package github
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// PushHook describes the hook for a push to a branch or tag
+type PushHook struct {
+	Ref     string         `json:"ref"`
+	Before  string         `json:"before"`
+	After   string         `json:"after"`
+	Created bool           `json:"created"`
+	Deleted bool           `json:"deleted"`
+	Forced  bool           `json:"forced"`
+	Commits []PushCommit   `json:"commits"`
+	Repo    HookRepository `json:"repository"`
+}
+
+// HookRepository describes the repository of a hook
+type HookRepository struct {
+	FullName string `json:"full_name"`
+}
+
+// CreateHook describes the hook for a branch or tag that was created
+type CreateHook struct {
+	Ref     string         `json:"ref"`
+	RefType string         `json:"ref_type"`
+	Repo    HookRepository `json:"repository"`
+}
+
+// Tag returns the tag that was created, or an empty string if a branch was
+// created.
+func (h CreateHook) Tag() string {
+	if h.RefType != "tag" {
+		return ""
+	}
+	return h.Ref
+}
+
+// PushCommit describes a commit in a push
+type PushCommit struct {
+	ID       string   `json:"id"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+// maxPushCommits is the number of commits GitHub includes in a push hook at
+// most.
+const maxPushCommits = 20
+
+// Branch returns the branch that was pushed to, or an empty string if a tag
+// was pushed.
+func (h PushHook) Branch() string {
+	if !strings.HasPrefix(h.Ref, "refs/heads/") {
+		return ""
+	}
+	return strings.TrimPrefix(h.Ref, "refs/heads/")
+}
+
+// Tag returns the tag that was pushed, or an empty string if a branch was
+// pushed to.
+func (h PushHook) Tag() string {
+	if !strings.HasPrefix(h.Ref, "refs/tags/") {
+		return ""
+	}
+	return strings.TrimPrefix(h.Ref, "refs/tags/")
+}
+
+// Files returns the files changed by the commits of the push. It returns
+// false if the hook does not list all of them.
+func (h PushHook) Files() ([]string, bool) {
+	if h.Forced || len(h.Commits) >= maxPushCommits {
+		return nil, false
+	}
+
+	var files []string
+	seen := map[string]bool{}
+	for _, c := range h.Commits {
+		for _, list := range [][]string{c.Added, c.Removed, c.Modified} {
+			for _, f := range list {
+				if !seen[f] {
+					seen[f] = true
+					files = append(files, f)
+				}
+			}
+		}
+	}
+
+	return files, true
+}
+
+// ParseCreateHook parses the web hook recieved into a CreateHook
+func ParseCreateHook(body io.Reader) (CreateHook, error) {
+	h := CreateHook{}
+	if err := json.NewDecoder(body).Decode(&h); err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
+
+// ParsePushHook parses the web hook recieved into a PushHook
+func ParsePushHook(body io.Reader) (PushHook, error) {
+	h := PushHook{}
+	if err := json.NewDecoder(body).Decode(&h); err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
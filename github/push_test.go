@@ -0,0 +1,55 @@
+package github
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePushHook(t *testing.T) {
+	body := `{
+		"ref": "refs/heads/master",
+		"before": "a10867b14bb761a232cd80139fbd4c0d33264240",
+		"after": "1481a2de7b2a7d02428ad93446ab166be7793fbb",
+		"commits": [
+			{"id": "1", "added": ["docs/new.md"], "removed": [], "modified": ["daemon/daemon.go"]},
+			{"id": "2", "added": [], "removed": ["old.go"], "modified": ["daemon/daemon.go"]}
+		],
+		"repository": {"full_name": "docker/docker"}
+	}`
+
+	h, err := ParsePushHook(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Repo.FullName != "docker/docker" {
+		t.Fatalf("expected repo docker/docker, was %s", h.Repo.FullName)
+	}
+	if h.Branch() != "master" || h.Tag() != "" {
+		t.Fatalf("expected branch master and no tag, was %q and %q", h.Branch(), h.Tag())
+	}
+
+	files, ok := h.Files()
+	if !ok {
+		t.Fatal("expected all files to be listed")
+	}
+	expected := []string{"docs/new.md", "daemon/daemon.go", "old.go"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected files %v, was %v", expected, files)
+	}
+}
+
+func TestPushHookTag(t *testing.T) {
+	h := PushHook{Ref: "refs/tags/v1.13.0"}
+	if h.Branch() != "" || h.Tag() != "v1.13.0" {
+		t.Fatalf("expected tag v1.13.0 and no branch, was %q and %q", h.Tag(), h.Branch())
+	}
+}
+
+func TestPushHookForcedFiles(t *testing.T) {
+	h := PushHook{Ref: "refs/heads/master", Forced: true}
+	if _, ok := h.Files(); ok {
+		t.Fatal("expected the files of a forced push to be unknown")
+	}
+}
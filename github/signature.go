@@ -0,0 +1,34 @@
+package github
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"strings"
+)
+
+// ValidSignature returns if the signature of a webhook, the value of its
+// X-Hub-Signature-256 or X-Hub-Signature header like "sha256=<hex>", was made
+// for the body with the secret of the webhook.
+func ValidSignature(secret string, body []byte, signature string) bool {
+	var h func() hash.Hash
+	switch {
+	case strings.HasPrefix(signature, "sha256="):
+		h = sha256.New
+	case strings.HasPrefix(signature, "sha1="):
+		h = sha1.New
+	default:
+		return false
+	}
+
+	sum, err := hex.DecodeString(signature[strings.Index(signature, "=")+1:])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sum, mac.Sum(nil))
+}
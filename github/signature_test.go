@@ -0,0 +1,30 @@
+package github
+
+import "testing"
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"action":"created"}`)
+
+	// made with: printf '%s' "$body" | openssl dgst -sha256 -hmac secret
+	signatures := []string{
+		"sha256=0031e94255b70a79704e0356204543768c078ca4f48b3ccc547edef03f4f338a",
+		"sha1=9e566b8b73b892dcaed1f3bce7db783024dcd7a8",
+	}
+	for _, signature := range signatures {
+		if !ValidSignature("secret", body, signature) {
+			t.Fatalf("expected %s to be valid", signature)
+		}
+		if ValidSignature("other", body, signature) {
+			t.Fatalf("expected %s not to be valid with another secret", signature)
+		}
+		if ValidSignature("secret", []byte(`{"action":"deleted"}`), signature) {
+			t.Fatalf("expected %s not to be valid for another body", signature)
+		}
+	}
+
+	for _, signature := range []string{"", "sha256", "md5=abc", "sha256=zz"} {
+		if ValidSignature("secret", body, signature) {
+			t.Fatalf("expected %q not to be valid", signature)
+		}
+	}
+}
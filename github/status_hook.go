@@ -0,0 +1,29 @@
+package github
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// StatusHook describes the hook for a status set on a commit
+type StatusHook struct {
+	Sha     string         `json:"sha"`
+	Context string         `json:"context"`
+	State   string         `json:"state"`
+	Repo    HookRepository `json:"repository"`
+}
+
+// Completed returns if the status is a final state
+func (h StatusHook) Completed() bool {
+	return h.State != "pending"
+}
+
+// ParseStatusHook parses the web hook recieved into a StatusHook
+func ParseStatusHook(body io.Reader) (StatusHook, error) {
+	h := StatusHook{}
+	if err := json.NewDecoder(body).Decode(&h); err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,27 @@
+package github
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStatusHook(t *testing.T) {
+	body := `{
+		"sha": "abc",
+		"context": "continuous-integration/jenkins/pr-merge",
+		"state": "success",
+		"repository": {"full_name": "docker/docker"}
+	}`
+
+	h, err := ParseStatusHook(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Sha != "abc" || h.Context != "continuous-integration/jenkins/pr-merge" || h.Repo.FullName != "docker/docker" {
+		t.Fatalf("unexpected hook %+v", h)
+	}
+	if !h.Completed() {
+		t.Fatal("expected a success status to be completed")
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -44,86 +48,210 @@ func jenkinsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// get the status for github
 	// and create a status description
-	desc := fmt.Sprintf("Jenkins build %s %d", j.Name, j.Build.Number)
-	var state string
-	if j.Build.Phase == "STARTED" {
-		state = "pending"
-		desc += " is running"
-	} else {
-
-		switch j.Build.Status {
-		case "SUCCESS":
-			state = "success"
-			desc += " has succeeded"
-		case "FAILURE":
-			state = "failure"
-			desc += " has failed"
-		case "UNSTABLE":
-			state = "failure"
-			desc += " was unstable"
-		case "ABORTED":
-			state = "error"
-			desc += " has encountered an error"
-		default:
-			logrus.Errorf("Did not understand %q build status. Aborting.", j.Build.Status)
+	state, desc := "pending", fmt.Sprintf("Jenkins build %s %d is running", j.Name, j.Build.Number)
+	if j.Build.Phase == "COMPLETED" {
+		var err error
+		state, desc, err = buildResultStatus(j.Name, j.Build.Number, j.Build.Status)
+		if err != nil {
+			logrus.Errorf("%v. Aborting.", err)
 			return
 		}
 	}
+
+	// find the jenkins master that sent the notification
+	master, err := config.getJenkinsForNotification(r.URL.Query().Get("token"), j.Build.URL)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	jc, err := config.getJenkins(master)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	// jenkins only sends the name of the job, so get the folders it is in
+	// from the build url
+	if name, err := jc.JobName(j.Build.URL); err == nil {
+		j.Name = name
+	}
+
 	// get the build
-	build, err := config.getBuildByJob(j.Name)
+	build, err := config.getBuildByJob(master, j.Name)
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
 
+	// skip notifications about builds that were superseded by a newer build
+	// of the same commit, or cancelled by leeroy. Other builds, like the ones
+	// rebuilt from the jenkins UI, become the tracked build.
+	if t, ok := tracker.get(j.Build.Parameters.GitSha, master, j.Name); ok && t.supersedes(j.Build) {
+		logrus.Infof("Ignoring notification for superseded build %s %d of %s", j.Name, j.Build.Number, j.Build.Parameters.GitSha)
+		return
+	} else if ok && t.State == "cancelled" && t.matches(j.Build) {
+		logrus.Infof("Ignoring notification for cancelled build %s %d of %s", j.Name, j.Build.Number, j.Build.Parameters.GitSha)
+		return
+	}
+
+	// note the base commit the merge commit was tested against
+	desc = withBaseSha(desc, j.Build.Parameters.GitBaseSha)
+
+	// add the test counts of completed builds to the description
+	var report *jenkins.TestReport
+	if j.Build.Phase == "COMPLETED" && build.TestReport {
+		report, err = jc.GetTestReport(context.Background(), j.Name, j.Build.Number)
+		if err != nil {
+			logrus.Warnf("requesting test report for job %s and build %d failed: %v", j.Name, j.Build.Number, err)
+		} else if report != nil {
+			desc += fmt.Sprintf(" (%s)", report.Summary())
+		}
+	}
+
+	// record the build and its state for the commit
+	tracker.update(j.Build.Parameters.GitSha, master, j.Name, func(t *trackedBuild) {
+		if j.Build.QueueID != 0 {
+			t.QueueID = j.Build.QueueID
+		}
+		t.Number = j.Build.Number
+		t.URL = j.Build.URL
+		t.State = state
+	})
+
 	// update the github status
 	if err := config.updateGithubStatus(j.Build.Parameters.GitBaseRepo, build.Context, j.Build.Parameters.GitSha, state, desc, j.Build.URL+"console"); err != nil {
 		logrus.Error(err)
 		return
 	}
 
-	/*
-		// if the build failed return get the build logs
-		if state == "failure" {
-			// setup the jenkins client
-			jc := &config.Jenkins
-			log, err := jc.GetBuildLog(j.Name, j.Build.Number)
-			if err != nil {
-				logrus.Errorf("requesting log for job %s and build %d failed: %v", j.Name, j.Build.Number, err)
+	if j.Build.Phase == "COMPLETED" {
+		number, _ := strconv.Atoi(j.Build.Parameters.PR)
+		config.buildCompleted(j.Build.Parameters.GitBaseRepo, j.Build.Parameters.GitSha, number)
+	}
+
+	// keep track of flaky tests and retry builds that only failed because
+	// of them
+	if j.Build.Phase == "COMPLETED" && (build.TestReport || build.TestNamePattern != "" || build.RetryFlaky) {
+		failed := config.recordTestResults(context.Background(), j, build, state, report)
+		if state == "failure" && config.retryFlakyBuild(context.Background(), j, build, failed) {
+			return
+		}
+	}
+
+	// remove the label that triggered an on demand build
+	if j.Build.Phase == "COMPLETED" && build.RemoveLabel && j.Build.Parameters.PR != "" {
+		if number, err := strconv.Atoi(j.Build.Parameters.PR); err == nil {
+			if err := config.removeBuildLabel(j.Build.Parameters.GitBaseRepo, number, build); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+
+	// comment on the pull request with the failed tests or the failures
+	// from the build log
+	if build.FailureComment && j.Build.Parameters.PR != "" {
+		number, err := strconv.Atoi(j.Build.Parameters.PR)
+		if err != nil {
+			logrus.Errorf("parsing PR %q of build %s %d failed: %v", j.Build.Parameters.PR, j.Name, j.Build.Number, err)
+			return
+		}
+
+		switch state {
+		case "failure":
+			var comment string
+			if report != nil {
+				comment = jenkins.TestReportComment(j.Name, j.Build.URL, report, build.MaxCommentSize)
+			}
+			if comment == "" {
+				comment, err = jc.GetBuildLog(context.Background(), j.Name, j.Build.Number, build.logFilter())
+				if err != nil {
+					logrus.Errorf("requesting log for job %s and build %d failed: %v", j.Name, j.Build.Number, err)
+					return
+				}
+			}
+			if comment == "" {
+				logrus.Infof("found no failures in log for job %s and build %d", j.Name, j.Build.Number)
 				return
 			}
 
-			// add comment to the PR
-			if err := config.addGithubComment(j.Build.Parameters.GitBaseRepo, j.Build.Parameters.PR, log); err != nil {
+			// add or update the comment on the PR
+			if err := config.setFailedBuildComment(j.Build.Parameters.GitBaseRepo, master, j.Name, number, comment); err != nil {
 				logrus.Error(err)
 				return
 			}
-			logrus.Infof("added comment to %s#%s", j.Build.Parameters.GitBaseRepo, j.Build.Parameters.PR)
-		}
-
-		if state == "success" {
+		case "success":
 			// find the comments about failed builds and remove them
-			number, _ := strconv.Atoi(j.Build.Parameters.PR)
-			if err := config.removeFailedBuildComment(j.Build.Parameters.GitBaseRepo, j.Name, number); err != nil {
+			if err := config.removeFailedBuildComment(j.Build.Parameters.GitBaseRepo, master, j.Name, number); err != nil {
 				logrus.Error(err)
 			}
 		}
-	*/
+	}
+
 	return
 }
 
+// buildCompleted moves on what waits for a build of a commit to complete,
+// once its status is set: the summary and the merge of its pull request, or
+// the merge queue batch it tests if it is not for a pull request, and the
+// builds queued until it made room for them.
+func (c Config) buildCompleted(repoName, sha string, number int) {
+	if number != 0 {
+		if err := c.updateSummary(repoName, sha, number); err != nil {
+			logrus.Error(err)
+		}
+		if err := c.tryAutoMerge(repoName, number); err != nil {
+			logrus.Error(err)
+		}
+	} else {
+		c.stagingBuildCompleted(repoName, sha)
+	}
+
+	dispatcher.wake()
+}
+
 func githubHandler(w http.ResponseWriter, r *http.Request) {
 	event := r.Header.Get("X-GitHub-Event")
 
+	// make sure the webhook comes from github, as the commands in comments
+	// and the author associations in it are trusted
+	if config.GHWebhookSecret != "" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logrus.Errorf("Error reading GitHub notification: %v", err)
+			w.WriteHeader(500)
+			return
+		}
+		signature := r.Header.Get("X-Hub-Signature-256")
+		if signature == "" {
+			signature = r.Header.Get("X-Hub-Signature")
+		}
+		if !github.ValidSignature(config.GHWebhookSecret, body, signature) {
+			logrus.Errorf("Got GitHub notification %s with an invalid signature", event)
+			w.WriteHeader(401)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
 	switch event {
 	case "":
 		logrus.Error("Got GitHub notification without a type")
 	case "ping":
 		w.WriteHeader(200)
-	//case "issues", "issue_comment":
+	//case "issues":
 	//	handleIssue(w, r)
+	case "issue_comment":
+		handleIssueComment(w, r)
+	case "pull_request_review":
+		handlePullRequestReview(w, r)
 	case "pull_request":
 		handlePullRequest(w, r)
+	case "push":
+		handlePush(w, r)
+	case "create":
+		handleCreate(w, r)
+	case "status":
+		handleStatus(w, r)
 	//case "pull_request_review_comment":
 	//	handlePullRequestReviewComment(w, r)
 	default:
@@ -131,6 +259,97 @@ func githubHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func handleIssueComment(w http.ResponseWriter, r *http.Request) {
+	hook, err := github.ParseIssueCommentHook(r.Body)
+	if err != nil {
+		logrus.Errorf("Error parsing issue comment hook: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	baseRepo := hook.Repo.FullName
+	rc := config.getRepoConfig(baseRepo)
+	if hook.Action != "created" || !hook.IsPullRequest() || hook.Issue.State != "open" {
+		logrus.Debugf("Ignoring comment on %s#%d", baseRepo, hook.Issue.Number)
+		return
+	}
+
+	var command string
+	switch {
+	case rc.RequireApproval && hook.HasCommand(rc.approvalCommand()):
+		command = rc.approvalCommand()
+	case rc.AutoMerge && hook.HasCommand(rc.mergeCommand()):
+		command = rc.mergeCommand()
+	default:
+		logrus.Debugf("Ignoring comment on %s#%d", baseRepo, hook.Issue.Number)
+		return
+	}
+
+	// only trusted users can give commands
+	if !rc.trusted(hook.Comment.AuthorAssociation) {
+		logrus.Warnf("Ignoring %s on %s#%d by untrusted user %s", command, baseRepo, hook.Issue.Number, hook.Comment.User.Login)
+		return
+	}
+
+	if command == rc.approvalCommand() {
+		err = config.approvePR(baseRepo, hook.Issue.Number, hook.Comment.User.Login)
+	} else {
+		err = config.requestMerge(baseRepo, hook.Issue.Number, hook.Comment.User.Login)
+	}
+	if err != nil {
+		logrus.Error(err)
+		w.WriteHeader(500)
+	}
+}
+
+func handlePullRequestReview(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logrus.Errorf("Error reading github pull request review handler body: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	hook, err := github.ParsePullRequestHookDetails(body)
+	if err != nil {
+		logrus.Errorf("Error parsing pull request review hook: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// a review may be what a PR waits for before it is merged
+	if hook.Action != "submitted" && hook.Action != "dismissed" {
+		return
+	}
+	if err := config.tryAutoMerge(hook.Repo.FullName, hook.PullRequest.Number); err != nil {
+		logrus.Error(err)
+		w.WriteHeader(500)
+	}
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	hook, err := github.ParseStatusHook(r.Body)
+	if err != nil {
+		logrus.Errorf("Error parsing status hook: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// jenkins sets the statuses of pipelines itself, so their status hooks
+	// are how leeroy learns about the pipelines the summary requires
+	baseRepo := hook.Repo.FullName
+	number, ok := summaries.requires(baseRepo, hook.Sha, hook.Context)
+	if !ok || !hook.Completed() {
+		return
+	}
+	build, err := config.getBuildByContextAndRepo(hook.Context, baseRepo)
+	if err != nil || !build.IsPipeline {
+		return
+	}
+
+	config.buildCompleted(baseRepo, hook.Sha, number)
+}
+
 func handleIssue(w http.ResponseWriter, r *http.Request) {
 	logrus.Debugf("Got an issue hook")
 
@@ -234,15 +453,116 @@ func handlePullRequest(w http.ResponseWriter, r *http.Request) {
 
 	logrus.Infof("Received GitHub pull request notification for %s %d (%s): %s", baseRepo, pr.Number, pr.URL, prHook.Action)
 
-	// ignore everything we don't care about
-	if prHook.Action != "opened" && prHook.Action != "reopened" && prHook.Action != "synchronize" {
+	details, err := github.ParsePullRequestHookDetails(body)
+	if err != nil {
+		logrus.Errorf("Error parsing pull request hook: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	rc := config.getRepoConfig(baseRepo)
+
+	switch prHook.Action {
+	case "opened", "reopened", "ready_for_review":
+	case "synchronize":
+		// the new head has to pass its builds before it can be merged
+		config.dequeuePR(baseRepo, pr.Number)
+
+		// the new commits of untrusted authors may need to be approved again
+		if err := config.requireReapproval(baseRepo, pr, details.PullRequest.AuthorAssociation); err != nil {
+			logrus.Error(err)
+			w.WriteHeader(500)
+			return
+		}
+	case "labeled":
+		if details.Label == nil {
+			return
+		}
+		// merge the PR once it can be
+		if rc.AutoMerge && details.Label.Name == rc.autoMergeLabel() {
+			if err := config.tryAutoMerge(baseRepo, pr.Number); err != nil {
+				logrus.Error(err)
+				w.WriteHeader(500)
+			}
+			return
+		}
+
+		// build everything if the label approves testing the PR, unless
+		// leeroy added it when it was approved by comment and built it then
+		if rc.RequireApproval && details.Label.Name == rc.approvalLabel() {
+			if details.Sender != nil && strings.EqualFold(details.Sender.Login, config.GHUser) {
+				return
+			}
+			break
+		}
+
+		// otherwise only build the jobs triggered by the label
+		labelBuilds := config.getLabelBuilds(baseRepo, details.Label.Name)
+		if len(labelBuilds) == 0 {
+			logrus.Debugf("Ignoring label %s of PR %s#%d", details.Label.Name, baseRepo, pr.Number)
+			return
+		}
+		config.requireContexts(baseRepo, pr.Head.Sha, pr.Number, labelBuilds)
+		for _, build := range labelBuilds {
+			if err := config.scheduleJenkinsBuild(context.Background(), baseRepo, pr.Number, "", build); err != nil {
+				logrus.Error(err)
+				w.WriteHeader(500)
+			}
+		}
+		return
+	case "edited":
+		// only build if the work in progress marker was removed from the title
+		from, ok := details.TitleChanged()
+		if !ok || !rc.isWIP(from) || rc.isWIP(pr.Title) {
+			logrus.Debugf("Ignoring edit of PR %s#%d", baseRepo, pr.Number)
+			return
+		}
+	case "closed", "converted_to_draft":
+		// stop building the PR
+		if prHook.Action == "closed" {
+			approvals.forget(baseRepo, pr.Number)
+			merges.forget(baseRepo, pr.Number)
+			debouncer.cancel(prKey(baseRepo, pr.Number))
+			config.dequeuePR(baseRepo, pr.Number)
+		}
+		reason := strings.Replace(prHook.Action, "_", " ", -1)
+		if err := config.cancelPRBuilds(context.Background(), baseRepo, pr, reason); err != nil {
+			logrus.Error(err)
+			w.WriteHeader(500)
+		}
+		return
+	default:
+		// ignore everything we don't care about
 		logrus.Debugf("Ignoring PR hook action %q", prHook.Action)
 		return
 	}
 
+	// coalesce pushes in quick succession, only building the latest one
+	if prHook.Action == "synchronize" && rc.DebounceWindow > 0 {
+		config.debouncePush(prHook, details)
+		w.WriteHeader(202)
+		return
+	}
+
+	if err := config.buildPullRequest(prHook, details); err != nil {
+		logrus.Error(err)
+		w.WriteHeader(500)
+	}
+}
+
+// buildPullRequest schedules the builds for the head of a pull request.
+func (c Config) buildPullRequest(prHook *octokat.PullRequestHook, details github.PullRequestHookDetails) error {
+	pr := prHook.PullRequest
+	baseRepo := fmt.Sprintf("%s/%s", pr.Base.Repo.Owner.Login, pr.Base.Repo.Name)
+	rc := c.getRepoConfig(baseRepo)
+
+	// hold the builds of drafts and work in progress until they are ready
+	if rc.holdsBuild(details.PullRequest.Draft, pr.Title) {
+		return c.deferPRBuilds(baseRepo, pr.Number, pr.Head.Sha)
+	}
+
 	g := github.GitHub{
-		AuthToken: config.GHToken,
-		User:      config.GHUser,
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
 	}
 
 	attempt, totalAttempts := 1, 5
@@ -257,22 +577,18 @@ retry:
 			delay *= 2
 			goto retry
 		}
-		w.WriteHeader(500)
-		return
+		return err
 	}
 
 	mergeable, err := g.IsMergeable(pullRequest)
 	if err != nil {
-		logrus.Errorf("Error checking if PR is mergeable: %v", err)
-		w.WriteHeader(500)
-		return
+		return fmt.Errorf("Error checking if PR is mergeable: %v", err)
 	}
 
 	// PR is not mergeable, so don't start the build
 	if !mergeable {
 		logrus.Errorf("Unmergeable PR for %s #%d. Aborting build", baseRepo, pr.Number)
-		w.WriteHeader(200)
-		return
+		return nil
 	}
 
 	var builds []Build
@@ -280,15 +596,20 @@ retry:
 	if !pullRequest.Content.IsNonCodeOnly() {
 		// get the builds -- skip pipeline jobs though, they'll be scheduled automatically
 		var err error
-		builds, err = config.getBuilds(baseRepo, false, false)
+		builds, err = c.getBuilds(baseRepo, false, false)
 		if err != nil {
 			logrus.Warn(err)
 		}
 	}
 
+	// rebuild the jobs triggered by the labels the PR still has
+	for _, l := range details.PullRequest.Labels {
+		builds = append(builds, c.getLabelBuilds(baseRepo, l.Name)...)
+	}
+
 	// If there are doc-changes validate them
 	if pullRequest.Content.HasDocsChanges() {
-		build, err := config.getBuildByContextAndRepo("doc", baseRepo)
+		build, err := c.getBuildByContextAndRepo("doc", baseRepo)
 		if err != nil {
 			logrus.Warnf("Adding doc build to %s for %d failed: %v", baseRepo, pr.Number, err)
 		} else {
@@ -298,7 +619,7 @@ retry:
 
 	// If there are vendoring changes validate them
 	if pullRequest.Content.HasVendoringChanges() {
-		build, err := config.getBuildByContextAndRepo("vendor", baseRepo)
+		build, err := c.getBuildByContextAndRepo("vendor", baseRepo)
 		if err != nil {
 			logrus.Warnf("Adding vendor build to %s for %d failed: %v", baseRepo, pr.Number, err)
 		} else {
@@ -306,16 +627,65 @@ retry:
 		}
 	}
 
+	// the builds that are run all need to pass for the PR
+	c.requireContexts(baseRepo, pr.Head.Sha, pr.Number, builds)
+
+	// the builds of maintainers are dispatched first
+	ctx := context.Background()
+	if rc.trusted(details.PullRequest.AuthorAssociation) {
+		ctx = withPriority(ctx, priorityMaintainer)
+	}
+
 	// schedule the jenkins builds
+	var lastErr error
 	for _, build := range builds {
 		// schedule the build
-		if err := config.scheduleJenkinsBuild(baseRepo, pr.Number, "", build); err != nil {
+		if err := c.scheduleJenkinsBuild(ctx, baseRepo, pr.Number, "", build); err != nil {
 			logrus.Error(err)
-			w.WriteHeader(500)
+			lastErr = err
 		}
 	}
 
-	return
+	return lastErr
+}
+
+// pullRequestHook loads a pull request like its webhook describes it, to
+// build it when leeroy did not get a webhook for it.
+func (c Config) pullRequestHook(baseRepo string, number int) (*octokat.PullRequestHook, github.PullRequestHookDetails, error) {
+	r := strings.SplitN(baseRepo, "/", 2)
+	if len(r) < 2 {
+		return nil, github.PullRequestHookDetails{}, fmt.Errorf("repo name could not be parsed: %s", baseRepo)
+	}
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	gh := octokat.NewClient()
+	gh = gh.WithToken(c.GHToken)
+	pr, err := gh.PullRequest(repo, strconv.Itoa(number), &octokat.Options{})
+	if err != nil {
+		return nil, github.PullRequestHookDetails{}, fmt.Errorf("getting pull request %s#%d failed: %v", baseRepo, number, err)
+	}
+
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	details, err := g.GetPullRequestDetails(repo, number)
+	if err != nil {
+		return nil, github.PullRequestHookDetails{}, fmt.Errorf("getting pull request %s#%d failed: %v", baseRepo, number, err)
+	}
+
+	prHook := &octokat.PullRequestHook{
+		Number:      number,
+		PullRequest: pr,
+		Repo:        pr.Base.Repo,
+	}
+	return prHook, github.PullRequestHookDetails{
+		PullRequest: *details,
+		Repo:        github.HookRepository{FullName: baseRepo},
+	}, nil
 }
 
 type requestBuild struct {
@@ -378,7 +748,7 @@ func customBuildHandler(w http.ResponseWriter, r *http.Request) {
 
 	// schedule the jenkins builds
 	for _, build := range builds {
-		if err := config.scheduleJenkinsBuild(b.Repo, b.Number, b.Ref, build); err != nil {
+		if err := config.scheduleJenkinsBuild(context.Background(), b.Repo, b.Number, b.Ref, build); err != nil {
 			logrus.Error(err)
 			w.WriteHeader(500)
 		}
@@ -415,29 +785,13 @@ func cronBuildHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get the build
-	build, err := config.getBuildByContextAndRepo(b.Context, b.Repo)
-	if err != nil {
+	// rebuild the PRs that have failed for the context
+	if _, err := config.rebuildFailedPRs(context.Background(), b.Repo, b.Context); err != nil {
 		logrus.Error(err)
 		w.WriteHeader(500)
 		return
 	}
 
-	// get PRs that have failed for the context
-	nums, err := config.getFailedPRs(b.Context, b.Repo)
-	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(500)
-		return
-	}
-
-	for _, prNum := range nums {
-		// schedule the jenkins build
-		if err := config.scheduleJenkinsBuild(b.Repo, prNum, "", build); err != nil {
-			logrus.Error(err)
-		}
-	}
-
 	w.WriteHeader(204)
 	return
 }
@@ -0,0 +1,58 @@
+package jenkins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// crumb is the CSRF protection token issued by the Jenkins crumb issuer.
+type crumb struct {
+	Field string `json:"crumbRequestField"`
+	Value string `json:"crumb"`
+}
+
+// getCrumb returns the cached crumb, requesting a new one from Jenkins if
+// there is none. If CSRF protection is disabled on the Jenkins instance an
+// empty crumb is returned.
+func (c *Client) getCrumb(ctx context.Context) (*crumb, error) {
+	c.mu.Lock()
+	cr := c.crumb
+	c.mu.Unlock()
+	if cr != nil {
+		return cr, nil
+	}
+
+	// do the request
+	url := fmt.Sprintf("%s/crumbIssuer/api/json", c.Baseurl)
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	cr = &crumb{}
+	switch resp.StatusCode {
+	case 200:
+		if err := json.NewDecoder(resp.Body).Decode(cr); err != nil {
+			return nil, fmt.Errorf("decoding json response from crumb issuer %s failed: %v", url, err)
+		}
+	case 404:
+		// the crumb issuer is disabled, so requests do not need a crumb
+	default:
+		return nil, fmt.Errorf("jenkins get crumb request to %s responded with status %d", url, resp.StatusCode)
+	}
+
+	c.mu.Lock()
+	c.crumb = cr
+	c.mu.Unlock()
+
+	return cr, nil
+}
+
+// resetCrumb drops the cached crumb so the next request fetches a new one.
+func (c *Client) resetCrumb() {
+	c.mu.Lock()
+	c.crumb = nil
+	c.mu.Unlock()
+}
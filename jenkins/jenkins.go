@@ -1,17 +1,15 @@
 package jenkins
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -22,6 +20,18 @@ type Client struct {
 	Baseurl  string `json:"base_url"`
 	Username string `json:"username"`
 	Token    string `json:"token"`
+	// Timeout is the timeout for requests to jenkins in seconds.
+	Timeout int `json:"timeout"`
+	// NotificationToken identifies the notifications sent by this jenkins
+	// instance, if they are sent with a token parameter.
+	NotificationToken string `json:"notification_token"`
+
+	// HTTPClient is the client used for all requests to jenkins. If it is
+	// not set a client using Timeout is created on first use.
+	HTTPClient *http.Client `json:"-"`
+
+	mu    sync.Mutex
+	crumb *crumb
 }
 
 // Response describes the response returned by jenkins
@@ -33,6 +43,7 @@ type Response struct {
 // Build describes a jenkins build
 type Build struct {
 	Number     int             `json:"number"`
+	QueueID    int             `json:"queue_id"`
 	URL        string          `json:"full_url"`
 	Phase      string          `json:"phase"`
 	Status     string          `json:"status"`
@@ -43,6 +54,7 @@ type Build struct {
 type BuildParameters struct {
 	GitBaseRepo string `json:"GIT_BASE_REPO"`
 	GitSha      string `json:"GIT_SHA1"`
+	GitBaseSha  string `json:"GIT_BASE_SHA1"`
 	PR          string `json:"PR"`
 }
 
@@ -59,12 +71,30 @@ type JobBuildsResponse struct {
 // RecentBuild describes a build from the Jenkins API.
 type RecentBuild struct {
 	ID        string    `json:"id,omitempty"`
+	Number    int       `json:"number,omitempty"`
+	QueueID   int       `json:"queueId,omitempty"`
+	URL       string    `json:"url,omitempty"`
 	Actions   []Action  `json:"actions,omitempty"`
 	Building  bool      `json:"building,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Duration  int64     `json:"duration,omitempty"`
 	Timestamp time.Time `json:"timstamp,omitempty"`
 	NodeName  string    `json:"builtOn,omitempty"`
 }
 
+// Parameter returns the value of a parameter the build was started with.
+func (b RecentBuild) Parameter(name string) string {
+	for _, a := range b.Actions {
+		for _, p := range a.Parameters {
+			if p.Name == name {
+				return p.Value
+			}
+		}
+	}
+
+	return ""
+}
+
 // Action defines the action for a build.
 type Action struct {
 	Parameters []Parameter `json:"parameters,omitempty"`
@@ -83,14 +113,39 @@ type QueuedBuildsResponse struct {
 
 // QueuedBuild represents a build in the queue.
 type QueuedBuild struct {
-	ID      int       `json:"id,omitempty"`
-	Actions []Action  `json:"actions,omitempty"`
-	Task    QueueTask `json:"task,omitempty"`
+	ID           int         `json:"id,omitempty"`
+	URL          string      `json:"url,omitempty"`
+	Actions      []Action    `json:"actions,omitempty"`
+	Task         QueueTask   `json:"task,omitempty"`
+	Why          string      `json:"why,omitempty"`
+	Blocked      bool        `json:"blocked,omitempty"`
+	Buildable    bool        `json:"buildable,omitempty"`
+	Cancelled    bool        `json:"cancelled,omitempty"`
+	InQueueSince int64       `json:"inQueueSince,omitempty"`
+	Executable   *Executable `json:"executable,omitempty"`
+}
+
+// Executable is the build jenkins started for an item that left the queue.
+type Executable struct {
+	Number int    `json:"number,omitempty"`
+	URL    string `json:"url,omitempty"`
 }
 
 // QueueTask is a task associated with a build in the queue.
 type QueueTask struct {
 	Name string `json:"name,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// isTask returns if a task in the queue is for the job. Jenkins only names
+// tasks after the job, not its folders, so the url of the task is used if
+// there is one.
+func (c *Client) isTask(t QueueTask, job string) bool {
+	if name, err := c.JobName(t.URL); err == nil {
+		return name == job
+	}
+
+	return t.Name == job
 }
 
 // New sets the authentication for the Jenkins client
@@ -105,29 +160,20 @@ func New(uri, username, token string) *Client {
 }
 
 // Build sends a build request to jenkins
-func (c *Client) Build(job string, data Request) error {
+func (c *Client) Build(ctx context.Context, job string, data Request) error {
 	// encode the request data
 	d, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	// set up the request
-	url := fmt.Sprintf("%s/job/%s/build", c.Baseurl, job)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(d))
-	if err != nil {
-		return err
-	}
-
-	// add the auth
-	req.SetBasicAuth(c.Username, c.Token)
-
 	// do the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	url := c.jobURL(job) + "/build"
+	resp, err := c.post(ctx, url, d)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	// check the status code
 	// it should be 201
@@ -138,53 +184,46 @@ func (c *Client) Build(job string, data Request) error {
 	return nil
 }
 
-// BuildWithParameters sends a build request with parameters to jenkins
-func (c *Client) BuildWithParameters(job string, parameters string) error {
-	// set up the request
-	url := fmt.Sprintf("%s/job/%s/buildWithParameters?%s", c.Baseurl, job, parameters)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte{}))
-	if err != nil {
-		return err
-	}
-
-	// add the auth
-	req.SetBasicAuth(c.Username, c.Token)
-
+// BuildWithParameters sends a build request with parameters to jenkins and
+// returns the queue item jenkins created for the build.
+func (c *Client) BuildWithParameters(ctx context.Context, job string, parameters string) (*QueuedBuild, error) {
 	// do the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	url := fmt.Sprintf("%s/buildWithParameters?%s", c.jobURL(job), parameters)
+	resp, err := c.post(ctx, url, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	// check the status code
 	// it should be 201
 	if resp.StatusCode != 201 {
-		return fmt.Errorf("jenkins post to %s responded with status %d", url, resp.StatusCode)
+		return nil, fmt.Errorf("jenkins post to %s responded with status %d", url, resp.StatusCode)
 	}
 
-	return nil
-}
-
-// BuildPipeline is just BuildWithParameters but for a Pipeline job instead.
-func (c *Client) BuildPipeline(job string, prNumber int, prRef string) error {
-	subJobName := prRef
-	if prNumber != 0 {
-		subJobName = fmt.Sprintf("PR-%d", prNumber)
-	}
-	url := fmt.Sprintf("%s/job/%s/job/%s/build", c.Baseurl, job, subJobName)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte{}))
+	// the location header points to the queue item for the build
+	location := resp.Header.Get("Location")
+	id, err := queueItemID(location)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("jenkins post to %s responded with an invalid queue item location %q: %v", url, location, err)
 	}
 
-	req.SetBasicAuth(c.Username, c.Token)
+	return &QueuedBuild{
+		ID:   id,
+		URL:  location,
+		Task: QueueTask{Name: job},
+	}, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// BuildPipeline is just BuildWithParameters but for a job in a multibranch
+// Pipeline project instead, see Multibranch.SubJob for its name.
+func (c *Client) BuildPipeline(ctx context.Context, job, subJob string) error {
+	url := fmt.Sprintf("%s/job/%s/build", c.jobURL(job), url.PathEscape(subJob))
+	resp, err := c.post(ctx, url, nil)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 201 {
 		return fmt.Errorf("jenkins post to %s responded with status %d", url, resp.StatusCode)
@@ -194,7 +233,7 @@ func (c *Client) BuildPipeline(job string, prNumber int, prRef string) error {
 }
 
 // CancelBuildsForPR cancels any queued or running builds for a PR.
-func (c *Client) CancelBuildsForPR(job, pr string) error {
+func (c *Client) CancelBuildsForPR(ctx context.Context, job, pr string) error {
 	if env := os.Getenv("LEEROY_KEEP_OLD_BUILD_RUNNING"); env != "" {
 		return errors.New("LEEROY_KEEP_OLD_BUILD_RUNNING is set")
 	}
@@ -202,24 +241,24 @@ func (c *Client) CancelBuildsForPR(job, pr string) error {
 	var e string
 
 	// first check the queue
-	q, err := c.GetQueuedBuildForPR(job, pr)
+	q, err := c.GetQueuedBuildForPR(ctx, job, pr)
 	if err != nil {
 		e = fmt.Sprintf("Getting queued build for job %s, pr %s failed: %v; ", job, pr, err)
 	} else if q != nil {
 		// if it is not nil then we found a matching build, cancel it
-		if err := c.CancelBuild(job, strconv.Itoa(q.ID), true); err != nil {
+		if err := c.CancelBuild(ctx, job, strconv.Itoa(q.ID), true); err != nil {
 			e = fmt.Sprintf("cancelling queued build for job %s, pr %s failed: %v; ", job, pr, err)
 		}
 		logrus.Infof("Cancelled queued build (%d) for job %s, pr %s", q.ID, job, pr)
 	}
 
 	// check running builds
-	b, err := c.GetRunningBuildForPR(job, pr)
+	b, err := c.GetRunningBuildForPR(ctx, job, pr)
 	if err != nil {
 		e += fmt.Sprintf("Getting running build for job %s, pr %s failed: %v;", job, pr, err)
 	} else if b != nil {
 		// if it is not nil then we found a matching build, cancel it
-		if err := c.CancelBuild(job, b.ID, false); err != nil {
+		if err := c.CancelBuild(ctx, job, b.ID, false); err != nil {
 			e += fmt.Sprintf("cancelling running build for job %s, pr %s failed: %v;", job, pr, err)
 		}
 		logrus.Infof("Cancelled running build (%s) for job %s, pr %s", b.ID, job, pr)
@@ -233,26 +272,19 @@ func (c *Client) CancelBuildsForPR(job, pr string) error {
 }
 
 // CancelBuild cancels/stops a running or queued build.
-func (c *Client) CancelBuild(job, id string, isQueued bool) error {
+func (c *Client) CancelBuild(ctx context.Context, job, id string, isQueued bool) error {
 	// set up the request
-	url := fmt.Sprintf("%s/job/%s/%s/stop", c.Baseurl, job, id)
+	url := fmt.Sprintf("%s/%s/stop", c.jobURL(job), id)
 	if isQueued {
 		url = fmt.Sprintf("%s/queue/cancelItem?id=%s", c.Baseurl, id)
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte{}))
-	if err != nil {
-		return err
-	}
-
-	// add the auth
-	req.SetBasicAuth(c.Username, c.Token)
 
 	// do the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.post(ctx, url, nil)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	// check the status code
 	// it should be 201
@@ -264,8 +296,8 @@ func (c *Client) CancelBuild(job, id string, isQueued bool) error {
 }
 
 // GetRunningBuildForPR returns the running build for a Jenkins job and PR if there is one.
-func (c *Client) GetRunningBuildForPR(job, pr string) (*RecentBuild, error) {
-	builds, err := c.GetBuilds(job)
+func (c *Client) GetRunningBuildForPR(ctx context.Context, job, pr string) (*RecentBuild, error) {
+	builds, err := c.GetBuilds(ctx, job)
 	if err != nil {
 		return nil, err
 	}
@@ -286,20 +318,10 @@ func (c *Client) GetRunningBuildForPR(job, pr string) (*RecentBuild, error) {
 }
 
 // GetBuilds gets the builds for a Jenkins job.
-func (c *Client) GetBuilds(job string) (b []RecentBuild, err error) {
-	// set up the request
-	url := fmt.Sprintf("%s/job/%s/api/json?tree=%s", c.Baseurl, job, url.QueryEscape("builds[builtOn,actions[parameters[name,value]],timestamp,id,building]"))
-	req, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
-	if err != nil {
-		return b, err
-	}
-
-	// add the auth
-	req.SetBasicAuth(c.Username, c.Token)
-
+func (c *Client) GetBuilds(ctx context.Context, job string) (b []RecentBuild, err error) {
 	// do the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	url := fmt.Sprintf("%s/api/json?tree=%s", c.jobURL(job), url.QueryEscape("builds[builtOn,actions[parameters[name,value]],timestamp,id,number,queueId,url,building,result,duration]"))
+	resp, err := c.get(ctx, url)
 	if err != nil {
 		return b, err
 	}
@@ -320,20 +342,10 @@ func (c *Client) GetBuilds(job string) (b []RecentBuild, err error) {
 }
 
 // GetQueuedBuildForPR returns the queued build for a Jenkins job and PR if there is one.
-func (c *Client) GetQueuedBuildForPR(job, pr string) (*QueuedBuild, error) {
-	// set up the request
-	url := fmt.Sprintf("%s/queue/api/json?tree=%s", c.Baseurl, url.QueryEscape("items[id,task[name]]"))
-	req, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
-	if err != nil {
-		return nil, err
-	}
-
-	// add the auth
-	req.SetBasicAuth(c.Username, c.Token)
-
+func (c *Client) GetQueuedBuildForPR(ctx context.Context, job, pr string) (*QueuedBuild, error) {
 	// do the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	url := fmt.Sprintf("%s/queue/api/json?tree=%s", c.Baseurl, url.QueryEscape("items[id,task[name,url],actions[parameters[name,value]]]"))
+	resp, err := c.get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -352,7 +364,7 @@ func (c *Client) GetQueuedBuildForPR(job, pr string) (*QueuedBuild, error) {
 
 	// loop through and collect only the ones that task name matches the job.
 	for _, build := range r.Builds {
-		if build.Task.Name == job {
+		if c.isTask(build.Task, job) {
 			for _, a := range build.Actions {
 				for _, p := range a.Parameters {
 					if p.Name == "PR" && p.Value == pr {
@@ -365,75 +377,3 @@ func (c *Client) GetQueuedBuildForPR(job, pr string) (*QueuedBuild, error) {
 
 	return nil, nil
 }
-
-// GetBuildLog returns the consoleText for a Jenkins build.
-func (c *Client) GetBuildLog(job string, id int) (string, error) {
-	// set up the request
-	url := fmt.Sprintf("%s/job/%s/%d/consoleText", c.Baseurl, job, id)
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// check the status code
-	// it should be 200
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("jenkins get logs request to %s responded with status %d", url, resp.StatusCode)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("reading body from logs response to %s failed: %v", url, err)
-	}
-
-	return parseFailedBuildLog(job, url, string(body)), nil
-}
-
-func parseFailedBuildLog(job, url, log string) string {
-	testComment := fmt.Sprintf(`Job: %s [FAILED](%s):
-
-~~~console
-
-`, job, strings.Replace(url, "consoleText", "console", 1))
-	// set the chars to resturn around the index where the line was matched
-	sl := 500
-
-	// first try to find FAIL in the log
-	re := regexp.MustCompile(`FAIL((.)*?)(\n|\r)`)
-	m := re.FindAllStringIndex(log, 1)
-
-	if len(m) == 0 {
-		// try another way, by looking for the end before the PostBuildScript
-		re = regexp.MustCompile(`PostBuildScript((.)*?)(\n|\r)`)
-		m = re.FindAllStringIndex(log, 1)
-	}
-
-	if len(m) == 0 {
-		// if still empty just return empty comment
-		return ""
-	}
-
-	// get the post build script index
-	pbIndex := strings.Index(log, "Now starting POST-BUILD steps")
-
-	for _, index := range m {
-		// get a few lines around the index
-		start := 0
-		if (index[0] - sl) > start {
-			start = index[0] - sl
-		}
-		end := len(log) - 1
-		if pbIndex > 5 {
-			// set the end to be that instead, since we don't need to include
-			// the post build script logs in the comment
-			end = pbIndex - 5
-		}
-		if index[1]+sl < end {
-			end = index[1] + sl
-		}
-		testComment += fmt.Sprintf("---\n%s\n---\n\n", log[start:end])
-	}
-
-	return testComment + "~~~"
-}
@@ -0,0 +1,92 @@
+package jenkins
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// defaultPRJobFormat is the name of the job for a pull request in a
+	// multibranch project if the config does not say otherwise.
+	defaultPRJobFormat = "PR-%d"
+
+	// BranchEscapeEncode url-encodes branch names, like jenkins does for the
+	// jobs of multibranch projects. It is the default.
+	BranchEscapeEncode = "encode"
+	// BranchEscapeDash replaces the slashes in branch names with dashes.
+	BranchEscapeDash = "dash"
+	// BranchEscapeNone uses branch names as they are.
+	BranchEscapeNone = "none"
+)
+
+// Multibranch describes how the jobs for pull requests and branches in a
+// multibranch project are named.
+type Multibranch struct {
+	// PRFormat is the name of the job for a pull request, formatted with
+	// its number. It defaults to "PR-%d".
+	PRFormat string `json:"pr_format"`
+	// BranchEscape is how a branch name is turned into the name of its job,
+	// one of "encode", "dash" or "none".
+	BranchEscape string `json:"branch_escape"`
+}
+
+// SubJob returns the name of the job for a pull request, or for the branch if
+// the pull request number is 0.
+func (m Multibranch) SubJob(prNumber int, branch string) string {
+	if prNumber != 0 {
+		format := m.PRFormat
+		if format == "" {
+			format = defaultPRJobFormat
+		}
+		return fmt.Sprintf(format, prNumber)
+	}
+
+	switch m.BranchEscape {
+	case BranchEscapeDash:
+		return strings.Replace(branch, "/", "-", -1)
+	case BranchEscapeNone:
+		return branch
+	default:
+		return url.PathEscape(branch)
+	}
+}
+
+// JobPath returns the url path of a job. Jobs in folders are named by their
+// folders and name separated by slashes, like "team/leeroy-prs".
+func JobPath(job string) string {
+	segments := strings.Split(strings.Trim(job, "/"), "/")
+	for i, s := range segments {
+		segments[i] = "job/" + url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// jobURL returns the url of a job.
+func (c *Client) jobURL(job string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(c.Baseurl, "/"), JobPath(job))
+}
+
+// JobName returns the full name of the job, including its folders, of a
+// build or job url of this jenkins instance.
+func (c *Client) JobName(buildURL string) (string, error) {
+	base := strings.TrimSuffix(c.Baseurl, "/") + "/"
+	if !strings.HasPrefix(buildURL, base) {
+		return "", fmt.Errorf("%s is not a url of jenkins %s", buildURL, c.Baseurl)
+	}
+
+	var names []string
+	segments := strings.Split(strings.TrimPrefix(buildURL, base), "/")
+	for i := 0; i+1 < len(segments) && segments[i] == "job"; i += 2 {
+		name, err := url.PathUnescape(segments[i+1])
+		if err != nil {
+			return "", fmt.Errorf("parsing job name from %s failed: %v", buildURL, err)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%s is not a url of a jenkins job", buildURL)
+	}
+
+	return strings.Join(names, "/"), nil
+}
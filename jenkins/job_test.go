@@ -0,0 +1,66 @@
+package jenkins
+
+import "testing"
+
+func TestJobPath(t *testing.T) {
+	cases := map[string]string{
+		"Docker-PRs":              "job/Docker-PRs",
+		"team/leeroy-prs":         "job/team/job/leeroy-prs",
+		"/team/leeroy prs/":       "job/team/job/leeroy%20prs",
+		"team/project/feature%2F": "job/team/job/project/job/feature%252F",
+	}
+
+	for job, expected := range cases {
+		if path := JobPath(job); path != expected {
+			t.Fatalf("expected %s, was %s, for: %s\n", expected, path, job)
+		}
+	}
+}
+
+func TestMultibranchSubJob(t *testing.T) {
+	cases := []struct {
+		m        Multibranch
+		pr       int
+		branch   string
+		expected string
+	}{
+		{Multibranch{}, 12, "master", "PR-12"},
+		{Multibranch{PRFormat: "MR-%d"}, 12, "master", "MR-12"},
+		{Multibranch{}, 0, "feature/foo", "feature%2Ffoo"},
+		{Multibranch{BranchEscape: BranchEscapeDash}, 0, "feature/foo", "feature-foo"},
+		{Multibranch{BranchEscape: BranchEscapeNone}, 0, "feature/foo", "feature/foo"},
+	}
+
+	for _, c := range cases {
+		if job := c.m.SubJob(c.pr, c.branch); job != c.expected {
+			t.Fatalf("expected %s, was %s, for: %+v %d %s\n", c.expected, job, c.m, c.pr, c.branch)
+		}
+	}
+}
+
+func TestJobName(t *testing.T) {
+	c := New("https://jenkins.dockerproject.com/", "", "")
+
+	cases := []struct {
+		url   string
+		name  string
+		valid bool
+	}{
+		{"https://jenkins.dockerproject.com/job/Docker-PRs/12/", "Docker-PRs", true},
+		{"https://jenkins.dockerproject.com/job/team/job/leeroy-prs/12/", "team/leeroy-prs", true},
+		{"https://jenkins.dockerproject.com/job/project/job/feature%252Ffoo/3/", "project/feature%2Ffoo", true},
+		{"https://jenkins.dockerproject.com/job/team/job/leeroy-prs/", "team/leeroy-prs", true},
+		{"https://jenkins.dockerproject.com/queue/item/1234/", "", false},
+		{"https://windows.jenkins.dockerproject.com/job/Docker-PRs/12/", "", false},
+	}
+
+	for _, tc := range cases {
+		name, err := c.JobName(tc.url)
+		if (err == nil) != tc.valid {
+			t.Fatalf("expected valid %v, was %v, for: %s\n", tc.valid, err, tc.url)
+		}
+		if name != tc.name {
+			t.Fatalf("expected %s, was %s, for: %s\n", tc.name, name, tc.url)
+		}
+	}
+}
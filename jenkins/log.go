@@ -0,0 +1,416 @@
+package jenkins
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultLogContext is the number of characters of the log included
+	// around a failure if the filter does not say otherwise.
+	defaultLogContext = 500
+
+	// defaultMaxCommentSize is the maximum size of a failure comment if the
+	// filter does not say otherwise.
+	defaultMaxCommentSize = 10000
+
+	// maxLogLine is the longest line of a log that is matched as a whole,
+	// longer lines are split.
+	maxLogLine = 64 * 1024
+
+	// sectionFormat is the format of each failure in a comment.
+	sectionFormat = "---\n%s\n---\n\n"
+
+	// postBuildMarker marks the start of the post build steps in a log,
+	// which are never included in a failure comment.
+	postBuildMarker = "Now starting POST-BUILD steps"
+)
+
+// defaultLogPatterns are used to find failures in a build log if the filter
+// does not have any patterns.
+var defaultLogPatterns = []string{
+	// first try to find FAIL in the log
+	`FAIL((.)*?)(\n|\r)`,
+	// try another way, by looking for the end before the PostBuildScript
+	`PostBuildScript((.)*?)(\n|\r)`,
+}
+
+// LogFilter describes how failures are extracted from a build log.
+type LogFilter struct {
+	// Patterns are regular expressions matching the lines of the log that
+	// show a failure. They are tried in order and the matches of the first
+	// one found in the log are used.
+	Patterns []string
+	// Context is the number of characters of the log included before and
+	// after each match.
+	Context int
+	// MaxSize is the maximum size of the failure comment.
+	MaxSize int
+	// Tail limits the search to the given number of bytes at the end of
+	// the log. The whole log is searched if it is zero.
+	Tail int64
+}
+
+func (f LogFilter) withDefaults() LogFilter {
+	if len(f.Patterns) == 0 {
+		f.Patterns = defaultLogPatterns
+	}
+	if f.Context <= 0 {
+		f.Context = defaultLogContext
+	}
+	if f.MaxSize <= 0 {
+		f.MaxSize = defaultMaxCommentSize
+	}
+	return f
+}
+
+// LogChunk is a part of a build log, starting at the offset it was requested
+// from.
+type LogChunk struct {
+	io.ReadCloser
+	// Next is the offset to request the following part of the log from,
+	// which is the size of the log when the chunk was requested.
+	Next int64
+	// More is true if the build is still running and the log may grow.
+	More bool
+}
+
+// GetBuildLogChunk returns the log of a Jenkins build from the given offset
+// to its current end using progressiveText. The caller must close the
+// returned chunk.
+func (c *Client) GetBuildLogChunk(ctx context.Context, job string, id int, start int64) (*LogChunk, error) {
+	// do the request
+	url := fmt.Sprintf("%s/%d/logText/progressiveText?start=%d", c.jobURL(job), id, start)
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	// check the status code
+	// it should be 200
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("jenkins get logs request to %s responded with status %d", url, resp.StatusCode)
+	}
+
+	next, err := strconv.ParseInt(resp.Header.Get("X-Text-Size"), 10, 64)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("parsing the log size jenkins responded with to %s failed: %v", url, err)
+	}
+
+	return &LogChunk{
+		ReadCloser: resp.Body,
+		Next:       next,
+		More:       resp.Header.Get("X-More-Data") == "true",
+	}, nil
+}
+
+// GetBuildLogSize returns the current size of the log of a Jenkins build,
+// without transferring the log.
+func (c *Client) GetBuildLogSize(ctx context.Context, job string, id int) (int64, error) {
+	url := fmt.Sprintf("%s/%d/logText/progressiveText?start=0", c.jobURL(job), id)
+	resp, err := c.head(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("jenkins log size request to %s responded with status %d", url, resp.StatusCode)
+	}
+
+	size, err := strconv.ParseInt(resp.Header.Get("X-Text-Size"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing the log size jenkins responded with to %s failed: %v", url, err)
+	}
+
+	return size, nil
+}
+
+// GetBuildLogTail returns the last size bytes of the log of a Jenkins build.
+// The caller must close the returned chunk.
+func (c *Client) GetBuildLogTail(ctx context.Context, job string, id int, size int64) (*LogChunk, error) {
+	// jenkins starts from the beginning if asked for an offset past the
+	// end of the log, so learn its size first
+	total, err := c.GetBuildLogSize(ctx, job, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if total <= size {
+		return c.GetBuildLogChunk(ctx, job, id, 0)
+	}
+
+	return c.GetBuildLogChunk(ctx, job, id, total-size)
+}
+
+// FollowBuildLog copies the log of a Jenkins build to w as it is written,
+// checking for more output every interval until the build completes.
+func (c *Client) FollowBuildLog(ctx context.Context, job string, id int, interval time.Duration, w io.Writer) error {
+	var start int64
+	for {
+		chunk, err := c.GetBuildLogChunk(ctx, job, id, start)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, chunk)
+		chunk.Close()
+		if err != nil {
+			return err
+		}
+
+		if !chunk.More {
+			return nil
+		}
+		start = chunk.Next
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// GetBuildLog returns a comment describing the failures found in the log of
+// a Jenkins build, or an empty string if no failure was found. The log is
+// searched as it is read, so only the comment is kept in memory.
+func (c *Client) GetBuildLog(ctx context.Context, job string, id int, filter LogFilter) (string, error) {
+	var (
+		chunk *LogChunk
+		err   error
+	)
+	if filter.Tail > 0 {
+		chunk, err = c.GetBuildLogTail(ctx, job, id, filter.Tail)
+	} else {
+		chunk, err = c.GetBuildLogChunk(ctx, job, id, 0)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer chunk.Close()
+
+	url := fmt.Sprintf("%s/%d/console", c.jobURL(job), id)
+	comment, err := parseFailedBuildLog(job, url, chunk, filter)
+	if err != nil {
+		return "", fmt.Errorf("reading the log of job %s build %d failed: %v", job, id, err)
+	}
+
+	return comment, nil
+}
+
+// failureSection collects the failures one pattern matches in a log.
+type failureSection struct {
+	re       *regexp.Regexp
+	sections []string
+	current  *strings.Builder
+	after    int // characters still to add to the current section
+	budget   int // characters that can still be added to the comment
+}
+
+// add appends text to the current section, as far as the budget allows.
+func (s *failureSection) add(text string) {
+	if s.budget <= 0 {
+		return
+	}
+	if len(text) > s.budget {
+		text = text[:s.budget]
+	}
+	s.current.WriteString(text)
+	s.budget -= len(text)
+}
+
+// close finishes the current section.
+func (s *failureSection) close() {
+	if s.current == nil {
+		return
+	}
+	s.sections = append(s.sections, s.current.String())
+	s.current = nil
+}
+
+// line looks for failures in a line of the log. before holds the end of the
+// log preceding the line.
+func (s *failureSection) line(before, line string, window int) {
+	if s.budget <= 0 {
+		s.close()
+		return
+	}
+
+	m := s.re.FindAllStringIndex(line, -1)
+	if len(m) == 0 {
+		// keep adding the log following the last failure
+		if s.current != nil {
+			text := line
+			if len(text) > s.after {
+				text = text[:s.after]
+			}
+			s.add(text)
+			s.after -= len(text)
+			if s.after <= 0 {
+				s.close()
+			}
+		}
+		return
+	}
+
+	first, last := m[0][0], m[len(m)-1][1]
+	if s.current == nil {
+		// start a new section with the log preceding the failure, if there
+		// is room left for it in the comment
+		s.budget -= len(sectionFormat) - len("%s")
+		if s.budget <= 0 {
+			return
+		}
+		s.current = &strings.Builder{}
+		s.add(tail(before+line[:first], window))
+		s.add(line[first:last])
+	} else {
+		// the failure is close to the last one, so merge them
+		s.add(line[:last])
+	}
+
+	text := line[last:]
+	if len(text) > window {
+		text = text[:window]
+	}
+	s.add(text)
+	s.after = window - len(text)
+	if s.after <= 0 {
+		s.close()
+	}
+}
+
+// tail returns the last n characters of s.
+func tail(s string, n int) string {
+	if len(s) > n {
+		return s[len(s)-n:]
+	}
+	return s
+}
+
+func parseFailedBuildLog(job, url string, log io.Reader, filter LogFilter) (string, error) {
+	f := filter.withDefaults()
+
+	testComment := fmt.Sprintf(`Job: %s [FAILED](%s):
+
+~~~console
+
+`, job, strings.Replace(url, "consoleText", "console", 1))
+	footer := "~~~"
+
+	// collect the failures for every pattern while reading the log once
+	var patterns []*failureSection
+	for _, p := range f.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return "", fmt.Errorf("compiling log pattern %q failed: %v", p, err)
+		}
+		patterns = append(patterns, &failureSection{
+			re:     re,
+			budget: f.MaxSize - len(testComment) - len(footer),
+		})
+	}
+
+	r := bufio.NewReaderSize(log, maxLogLine)
+	var before string
+	for {
+		l, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return "", err
+		}
+		line := string(l)
+
+		// we don't need to include the post build script logs in the comment
+		if strings.Contains(line, postBuildMarker) {
+			break
+		}
+
+		for _, p := range patterns {
+			p.line(before, line, f.Context)
+		}
+		before = tail(before+line, f.Context)
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	// use the failures of the first pattern found in the log
+	for _, p := range patterns {
+		p.close()
+		if len(p.sections) == 0 {
+			continue
+		}
+
+		for _, section := range p.sections {
+			testComment += fmt.Sprintf(sectionFormat, section)
+		}
+		return testComment + footer, nil
+	}
+
+	// if still empty just return empty comment
+	return "", nil
+}
+
+// GetFailedTests returns the names of the failed tests found in the log of a
+// Jenkins build. The first group of pattern must match the name of a test.
+func (c *Client) GetFailedTests(ctx context.Context, job string, id int, pattern string, tail int64) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("compiling test name pattern %q failed: %v", pattern, err)
+	}
+
+	var chunk *LogChunk
+	if tail > 0 {
+		chunk, err = c.GetBuildLogTail(ctx, job, id, tail)
+	} else {
+		chunk, err = c.GetBuildLogChunk(ctx, job, id, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer chunk.Close()
+
+	tests, err := failedTestsInLog(chunk, re)
+	if err != nil {
+		return nil, fmt.Errorf("reading the log of job %s build %d failed: %v", job, id, err)
+	}
+
+	return tests, nil
+}
+
+func failedTestsInLog(log io.Reader, re *regexp.Regexp) ([]string, error) {
+	var tests []string
+	seen := map[string]bool{}
+
+	r := bufio.NewReaderSize(log, maxLogLine)
+	for {
+		l, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return nil, err
+		}
+
+		for _, m := range re.FindAllSubmatch(l, -1) {
+			if len(m) < 2 || len(m[1]) == 0 {
+				continue
+			}
+			if name := string(m[1]); !seen[name] {
+				seen[name] = true
+				tests = append(tests, name)
+			}
+		}
+
+		if err == io.EOF {
+			return tests, nil
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package jenkins
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseFailedBuildLog(t *testing.T) {
+	log := "--- PASS: TestOne\n--- FAIL: TestTwo\nsome output\n" + postBuildMarker + "\nPostBuildScript cleanup\n"
+
+	cases := []struct {
+		filter   LogFilter
+		contains []string
+		excludes []string
+	}{
+		{
+			LogFilter{},
+			[]string{"Job: Docker-PRs [FAILED](https://jenkins/job/Docker-PRs/1/console)", "--- FAIL: TestTwo"},
+			[]string{"PostBuildScript cleanup"},
+		},
+		{
+			LogFilter{Patterns: []string{`panic:`, `PASS: (\w+)`}, Context: 1},
+			[]string{"PASS: TestOne"},
+			[]string{"TestTwo"},
+		},
+		{
+			LogFilter{Patterns: []string{`no such line`}},
+			nil,
+			[]string{"Job: Docker-PRs"},
+		},
+	}
+
+	for _, c := range cases {
+		comment, err := parseFailedBuildLog("Docker-PRs", "https://jenkins/job/Docker-PRs/1/consoleText", strings.NewReader(log), c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range c.contains {
+			if !strings.Contains(comment, s) {
+				t.Fatalf("expected comment to contain %q, was: %s\n", s, comment)
+			}
+		}
+		for _, s := range c.excludes {
+			if strings.Contains(comment, s) {
+				t.Fatalf("expected comment not to contain %q, was: %s\n", s, comment)
+			}
+		}
+	}
+}
+
+func TestParseFailedBuildLogMaxSize(t *testing.T) {
+	log := strings.Repeat("FAIL: TestSomething\n", 1000)
+
+	comment, err := parseFailedBuildLog("Docker-PRs", "https://jenkins/job/Docker-PRs/1/consoleText", strings.NewReader(log), LogFilter{MaxSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comment) > 1000 {
+		t.Fatalf("expected comment of at most 1000 characters, was %d", len(comment))
+	}
+	if !strings.HasSuffix(comment, "~~~") {
+		t.Fatalf("expected comment to be terminated, was: %s", comment)
+	}
+}
+
+func TestParseFailedBuildLogLongLines(t *testing.T) {
+	log := strings.Repeat("x", 3*maxLogLine) + "\n--- FAIL: TestLong\n"
+
+	comment, err := parseFailedBuildLog("Docker-PRs", "https://jenkins/job/Docker-PRs/1/consoleText", strings.NewReader(log), LogFilter{Context: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(comment, "xxxxx\n--- FAIL: TestLong") {
+		t.Fatalf("expected comment to contain the failure, was: %s", comment)
+	}
+}
+
+func TestGetBuildLogTail(t *testing.T) {
+	log := strings.Repeat("x", 1000) + "tail of the log\n"
+
+	var transferred int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		w.Header().Set("X-Text-Size", strconv.Itoa(len(log)))
+		if r.Method == "HEAD" {
+			return
+		}
+		transferred += len(log) - start
+		w.Write([]byte(log[start:]))
+	}))
+	defer ts.Close()
+
+	c := &Client{Baseurl: ts.URL}
+	chunk, err := c.GetBuildLogTail(context.Background(), "Docker-PRs", 1, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunk.Close()
+
+	b, err := ioutil.ReadAll(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "tail of the log\n" {
+		t.Fatalf("expected the tail of the log, was %q", b)
+	}
+	if transferred != 16 {
+		t.Fatalf("expected only the tail to be transferred, was %d bytes", transferred)
+	}
+}
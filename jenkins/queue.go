@@ -0,0 +1,144 @@
+package jenkins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	queueItemRegex = regexp.MustCompile(`/queue/item/(\d+)/?$`)
+
+	// ErrQueueItemCancelled is returned when waiting for a queue item that
+	// was cancelled before jenkins started a build for it.
+	ErrQueueItemCancelled = errors.New("queue item was cancelled")
+)
+
+// queueItemID parses the id of a queue item from its url.
+func queueItemID(location string) (int, error) {
+	m := queueItemRegex.FindStringSubmatch(location)
+	if m == nil {
+		return 0, errors.New("not a queue item url")
+	}
+
+	return strconv.Atoi(m[1])
+}
+
+// GetQueueItem returns the state of an item in the jenkins queue. Jenkins
+// keeps items that left the queue around for a few minutes, during which
+// Executable holds the build that was started for it.
+func (c *Client) GetQueueItem(ctx context.Context, id int) (*QueuedBuild, error) {
+	// do the request
+	url := fmt.Sprintf("%s/queue/item/%d/api/json", c.Baseurl, id)
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// check the status code
+	// it should be 200
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("jenkins get queue item request to %s responded with status %d", url, resp.StatusCode)
+	}
+
+	var q QueuedBuild
+	if err := json.NewDecoder(resp.Body).Decode(&q); err != nil {
+		return nil, fmt.Errorf("decoding json response from queue item %s failed: %v", url, err)
+	}
+
+	return &q, nil
+}
+
+// WaitForBuild polls a queue item every interval until jenkins starts a
+// build for it and returns that build. If progress is not nil it is called
+// with the state of the item each time it is found still waiting in the
+// queue.
+func (c *Client) WaitForBuild(ctx context.Context, id int, interval time.Duration, progress func(q *QueuedBuild)) (*Executable, error) {
+	for {
+		q, err := c.GetQueueItem(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if q.Executable != nil {
+			return q.Executable, nil
+		}
+		if q.Cancelled {
+			return nil, ErrQueueItemCancelled
+		}
+		if progress != nil {
+			progress(q)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// QueuePosition returns the position of an item in the jenkins queue,
+// starting at 1 for the item that has been waiting the longest. It returns 0
+// if the item is not in the queue.
+func (c *Client) QueuePosition(ctx context.Context, id int) (int, error) {
+	// do the request
+	url := fmt.Sprintf("%s/queue/api/json?tree=%s", c.Baseurl, url.QueryEscape("items[id,inQueueSince]"))
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// check the status code
+	// it should be 200
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("jenkins get queued builds request to %s responded with status %d", url, resp.StatusCode)
+	}
+
+	var r QueuedBuildsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return 0, fmt.Errorf("decoding json response from queued builds from %s failed: %v", url, err)
+	}
+
+	var item *QueuedBuild
+	for i := range r.Builds {
+		if r.Builds[i].ID == id {
+			item = &r.Builds[i]
+		}
+	}
+	if item == nil {
+		return 0, nil
+	}
+
+	position := 1
+	for _, b := range r.Builds {
+		if b.InQueueSince < item.InQueueSince {
+			position++
+		}
+	}
+
+	return position, nil
+}
+
+// CancelQueuedBuild cancels a build that was scheduled as the given queue
+// item. If the item already left the queue the build started for it is
+// stopped instead.
+func (c *Client) CancelQueuedBuild(ctx context.Context, job string, id int) error {
+	q, err := c.GetQueueItem(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if q.Executable != nil {
+		return c.CancelBuild(ctx, job, strconv.Itoa(q.Executable.Number), false)
+	}
+
+	return c.CancelBuild(ctx, job, strconv.Itoa(id), true)
+}
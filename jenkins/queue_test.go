@@ -0,0 +1,26 @@
+package jenkins
+
+import "testing"
+
+func TestQueueItemID(t *testing.T) {
+	cases := []struct {
+		location string
+		id       int
+		valid    bool
+	}{
+		{"https://jenkins.dockerproject.com/queue/item/1234/", 1234, true},
+		{"https://jenkins.dockerproject.com/queue/item/1234", 1234, true},
+		{"https://jenkins.dockerproject.com/job/Docker-PRs/", 0, false},
+		{"", 0, false},
+	}
+
+	for _, c := range cases {
+		id, err := queueItemID(c.location)
+		if (err == nil) != c.valid {
+			t.Fatalf("expected valid %v, was %v, for: %s\n", c.valid, err, c.location)
+		}
+		if id != c.id {
+			t.Fatalf("expected %d, was %d, for: %s\n", c.id, id, c.location)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package jenkins
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultTimeout is used for requests to jenkins when the client does
+	// not have a timeout configured.
+	defaultTimeout = 30 * time.Second
+
+	// getAttempts is the number of times a GET request is tried before the
+	// server error jenkins responded with is returned.
+	getAttempts = 3
+)
+
+// httpClient returns the http client shared by all requests to jenkins,
+// creating one with the configured timeout on first use. The cookie jar of
+// the client keeps the session a crumb is bound to between requests.
+func (c *Client) httpClient() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.HTTPClient == nil {
+		timeout := defaultTimeout
+		if c.Timeout > 0 {
+			timeout = time.Duration(c.Timeout) * time.Second
+		}
+
+		// cookiejar.New only returns an error for invalid options
+		jar, _ := cookiejar.New(nil)
+
+		c.HTTPClient = &http.Client{
+			Timeout: timeout,
+			Jar:     jar,
+		}
+	}
+
+	return c.HTTPClient
+}
+
+// get sends an authenticated GET request to jenkins. Requests jenkins
+// responds to with a server error are retried with an exponential backoff.
+// The caller must close the body of the returned response.
+func (c *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	return c.read(ctx, "GET", url)
+}
+
+// head sends an authenticated HEAD request to jenkins, retried like get.
+func (c *Client) head(ctx context.Context, url string) (*http.Response, error) {
+	return c.read(ctx, "HEAD", url)
+}
+
+// read sends a request that does not change anything to jenkins, retrying
+// it on server errors.
+func (c *Client) read(ctx context.Context, method, url string) (*http.Response, error) {
+	attempt := 1
+	delay := time.Second
+	for {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		// add the auth
+		req.SetBasicAuth(c.Username, c.Token)
+
+		// do the request
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode < 500 || attempt >= getAttempts {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		logrus.Warnf("jenkins %s request to %s responded with status %d (attempt %d/%d)", method, url, resp.StatusCode, attempt, getAttempts)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		attempt++
+		delay *= 2
+	}
+}
+
+// post sends an authenticated POST request to jenkins with the CSRF crumb
+// attached. If Jenkins rejects the crumb it is refreshed and the request is
+// sent once more. The caller must close the body of the returned response.
+func (c *Client) post(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		cr, err := c.getCrumb(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		// add the auth and the crumb
+		req.SetBasicAuth(c.Username, c.Token)
+		if cr.Field != "" {
+			req.Header.Set(cr.Field, cr.Value)
+		}
+
+		// do the request
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// jenkins responds with a 403 if the crumb is missing, invalid or
+		// expired along with the session it was issued for
+		if resp.StatusCode == 403 && attempt == 1 {
+			resp.Body.Close()
+			c.resetCrumb()
+			continue
+		}
+
+		return resp, nil
+	}
+}
@@ -0,0 +1,171 @@
+package jenkins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// errorLines is the number of lines of a test error shown in a comment.
+	errorLines = 3
+)
+
+// TestReport describes the JUnit test results of a build.
+type TestReport struct {
+	FailCount int         `json:"failCount"`
+	PassCount int         `json:"passCount"`
+	SkipCount int         `json:"skipCount"`
+	Suites    []TestSuite `json:"suites,omitempty"`
+}
+
+// TestSuite is a suite of test cases in a test report.
+type TestSuite struct {
+	Name  string     `json:"name,omitempty"`
+	Cases []TestCase `json:"cases,omitempty"`
+}
+
+// TestCase is the result of a single test.
+type TestCase struct {
+	ClassName       string  `json:"className,omitempty"`
+	Name            string  `json:"name,omitempty"`
+	Duration        float64 `json:"duration,omitempty"`
+	Status          string  `json:"status,omitempty"`
+	ErrorDetails    string  `json:"errorDetails,omitempty"`
+	ErrorStackTrace string  `json:"errorStackTrace,omitempty"`
+}
+
+// Failed returns if the test case failed.
+func (t TestCase) Failed() bool {
+	return t.Status == "FAILED" || t.Status == "REGRESSION"
+}
+
+// Passed returns if the test case passed.
+func (t TestCase) Passed() bool {
+	return t.Status == "PASSED" || t.Status == "FIXED"
+}
+
+// FullName returns the name of the test case including its class.
+func (t TestCase) FullName() string {
+	if t.ClassName == "" {
+		return t.Name
+	}
+	return t.ClassName + "." + t.Name
+}
+
+// Failures returns the test cases that failed.
+func (r TestReport) Failures() (cases []TestCase) {
+	for _, s := range r.Suites {
+		for _, c := range s.Cases {
+			if c.Failed() {
+				cases = append(cases, c)
+			}
+		}
+	}
+	return cases
+}
+
+// Summary returns the test counts of the report.
+func (r TestReport) Summary() string {
+	return fmt.Sprintf("%d failed, %d passed, %d skipped", r.FailCount, r.PassCount, r.SkipCount)
+}
+
+// GetTestReport returns the JUnit test report of a completed Jenkins build,
+// or nil if the build did not publish one.
+func (c *Client) GetTestReport(ctx context.Context, job string, id int) (*TestReport, error) {
+	// do the request
+	url := fmt.Sprintf("%s/%d/testReport/api/json?tree=%s", c.jobURL(job), id, url.QueryEscape("failCount,passCount,skipCount,suites[name,cases[className,name,duration,status,errorDetails,errorStackTrace]]"))
+	resp, err := c.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// jenkins responds with a 404 for builds without test results
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+
+	// check the status code
+	// it should be 200
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("jenkins get test report request to %s responded with status %d", url, resp.StatusCode)
+	}
+
+	var r TestReport
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("decoding json response from test report %s failed: %v", url, err)
+	}
+
+	return &r, nil
+}
+
+// TestReportComment returns a comment with a table of the failed test cases
+// in a test report, limited to maxSize characters. It returns an empty string
+// if no test failed.
+func TestReportComment(job, buildURL string, r *TestReport, maxSize int) string {
+	failures := r.Failures()
+	if len(failures) == 0 {
+		return ""
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxCommentSize
+	}
+
+	comment := fmt.Sprintf(`Job: %s [FAILED](%s):
+
+%s
+
+| Class | Test | Duration | Error |
+| --- | --- | --- | --- |
+`, job, buildURL+"testReport", r.Summary())
+
+	for i, f := range failures {
+		row := fmt.Sprintf("| %s | %s | %s | %s |\n",
+			tableCell(f.ClassName),
+			tableCell(f.Name),
+			time.Duration(f.Duration*float64(time.Second)).String(),
+			tableCell(firstLines(f.errorText(), errorLines)),
+		)
+
+		more := fmt.Sprintf("\nand %d more failures\n", len(failures)-i)
+		if len(comment)+len(row)+len(more) > maxSize {
+			return comment + more
+		}
+		comment += row
+	}
+
+	return comment
+}
+
+// errorText returns the error message of a failed test case, falling back to
+// its stack trace.
+func (t TestCase) errorText() string {
+	if t.ErrorDetails != "" {
+		return t.ErrorDetails
+	}
+	return t.ErrorStackTrace
+}
+
+// firstLines returns the first n non-empty lines of s.
+func firstLines(s string, n int) string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+		if len(lines) == n {
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// tableCell escapes text for use in a markdown table cell.
+func tableCell(s string) string {
+	s = strings.Replace(s, "|", "\\|", -1)
+	return strings.Replace(s, "\n", "<br>", -1)
+}
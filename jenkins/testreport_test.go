@@ -0,0 +1,40 @@
+package jenkins
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTestReportComment(t *testing.T) {
+	r := &TestReport{
+		FailCount: 1,
+		PassCount: 2,
+		Suites: []TestSuite{
+			{
+				Cases: []TestCase{
+					{ClassName: "integration", Name: "TestPass", Status: "PASSED"},
+					{ClassName: "integration", Name: "TestFixed", Status: "FIXED"},
+					{ClassName: "integration", Name: "TestFail", Status: "REGRESSION", Duration: 1.5, ErrorDetails: "expected | got\nline two\nline three\nline four"},
+				},
+			},
+		},
+	}
+
+	comment := TestReportComment("Docker-PRs", "https://jenkins/job/Docker-PRs/1/", r, 0)
+	for _, s := range []string{
+		"Job: Docker-PRs [FAILED](https://jenkins/job/Docker-PRs/1/testReport)",
+		"1 failed, 2 passed, 0 skipped",
+		"| integration | TestFail | 1.5s | expected \\| got<br>line two<br>line three |",
+	} {
+		if !strings.Contains(comment, s) {
+			t.Fatalf("expected comment to contain %q, was: %s", s, comment)
+		}
+	}
+	if strings.Contains(comment, "TestPass") || strings.Contains(comment, "line four") {
+		t.Fatalf("expected comment to only contain the first lines of failures, was: %s", comment)
+	}
+
+	if comment := TestReportComment("Docker-PRs", "https://jenkins/job/Docker-PRs/1/", &TestReport{PassCount: 1}, 0); comment != "" {
+		t.Fatalf("expected no comment without failures, was: %s", comment)
+	}
+}
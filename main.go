@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/leeroy/jenkins"
@@ -32,13 +33,99 @@ var (
 
 // Config describes the leeroy config file
 type Config struct {
-	Jenkins      jenkins.Client `json:"jenkins"`
-	BuildCommits string         `json:"build_commits"`
-	GHToken      string         `json:"github_token"`
-	GHUser       string         `json:"github_user"`
-	Builds       []Build        `json:"builds"`
-	User         string         `json:"user"`
-	Pass         string         `json:"pass"`
+	Jenkins      *jenkins.Client `json:"jenkins"`
+	BuildCommits string          `json:"build_commits"`
+	GHToken      string          `json:"github_token"`
+	GHUser       string          `json:"github_user"`
+	Builds       []Build         `json:"builds"`
+	User         string          `json:"user"`
+	Pass         string          `json:"pass"`
+
+	// GHWebhookSecret is the secret of the github webhook. The signatures of
+	// the webhooks are checked with it if it is set, which repositories that
+	// require approval or merge pull requests need.
+	GHWebhookSecret string `json:"github_webhook_secret"`
+
+	// JenkinsMasters are additional jenkins masters by name, which builds
+	// select with their jenkins field. Builds without one use Jenkins.
+	JenkinsMasters map[string]*jenkins.Client `json:"jenkins_masters"`
+
+	// ReconcileInterval is how often pending builds are checked with
+	// jenkins, in seconds. It defaults to 300, a negative value disables the
+	// checks.
+	ReconcileInterval int `json:"reconcile_interval"`
+	// ReconcileMaxAge is how long a build may stay pending before its
+	// status is set to error, in seconds. It defaults to 21600.
+	ReconcileMaxAge int `json:"reconcile_max_age"`
+
+	// Schedules are the tasks leeroy runs periodically.
+	Schedules []ScheduleConfig `json:"schedules"`
+
+	// Repos holds the settings of repositories by name, like
+	// "docker/docker".
+	Repos map[string]RepoConfig `json:"repos"`
+
+	// Dispatch limits the number of builds leeroy runs on jenkins at once.
+	// Builds are sent to jenkins right away if it is not set.
+	Dispatch *DispatchConfig `json:"dispatch"`
+}
+
+// RepoConfig describes how leeroy handles the events of a repository
+type RepoConfig struct {
+	// BasePushPolicy is what happens to the open pull requests against a
+	// branch that is pushed to: "none", "stale", "rebuild" or "overlap".
+	BasePushPolicy string `json:"base_push_policy"`
+	// BaseBranches limits the policy to pushes to these branches. It
+	// applies to all branches if empty.
+	BaseBranches []string `json:"base_branches"`
+	// RebuildInterval is the number of seconds between scheduling the
+	// rebuilds of pull requests.
+	RebuildInterval int `json:"rebuild_interval"`
+	// DraftPolicy is what happens to draft pull requests and pull
+	// requests whose title starts with one of WIPPrefixes: "build", "skip"
+	// or "defer".
+	DraftPolicy string `json:"draft_policy"`
+	// WIPPrefixes are the title prefixes, matched case insensitively, that
+	// mark a pull request as work in progress.
+	WIPPrefixes []string `json:"wip_prefixes"`
+	// DeferredDescription is the description of the status set on deferred
+	// builds.
+	DeferredDescription string `json:"deferred_description"`
+	// RequireApproval holds the builds of pull requests by untrusted
+	// authors until a trusted user comments ApprovalCommand or adds
+	// ApprovalLabel.
+	RequireApproval bool `json:"require_approval"`
+	// TrustedAssociations are the associations with the repository, like
+	// "MEMBER", of trusted users.
+	TrustedAssociations []string `json:"trusted_associations"`
+	ApprovalCommand     string   `json:"approval_command"`
+	ApprovalLabel       string   `json:"approval_label"`
+	// ReapproveOnPush requires approving pull requests by untrusted
+	// authors again after each push.
+	ReapproveOnPush bool `json:"reapprove_on_push"`
+	// Summary enables setting a status with SummaryContext on the heads of
+	// pull requests that sums up the statuses of the builds they need.
+	Summary        bool   `json:"summary"`
+	SummaryContext string `json:"summary_context"`
+	// AutoMerge enables merging pull requests with AutoMergeLabel, or for
+	// which a trusted user commented MergeCommand, once all the builds
+	// they need passed, they have RequiredApprovals approving reviews and
+	// they can be merged. The status with AutoMergeContext says what they
+	// are waiting for.
+	AutoMerge         bool   `json:"automerge"`
+	AutoMergeLabel    string `json:"automerge_label"`
+	MergeCommand      string `json:"merge_command"`
+	AutoMergeContext  string `json:"automerge_context"`
+	RequiredApprovals int    `json:"required_approvals"`
+	// MergeMethod is "merge", "squash" or "rebase".
+	MergeMethod string `json:"merge_method"`
+	// MergeQueue makes pull requests that can be merged enter a merge
+	// queue instead of being merged right away.
+	MergeQueue *MergeQueueConfig `json:"merge_queue"`
+	// DebounceWindow is the number of seconds the builds of a push to a
+	// pull request wait for another push. Only the last of the pushes is
+	// built.
+	DebounceWindow int `json:"debounce_window"`
 }
 
 // Build describes the paramaters for a build
@@ -49,6 +136,67 @@ type Build struct {
 	Custom       bool   `json:"custom"`
 	HandleIssues bool   `json:"handle_issues"`
 	IsPipeline   bool   `json:"is_pipeline"`
+
+	// Branches and Tags are patterns of the branches and tags that are
+	// built when they are pushed, like "master" or "v*". Builds with
+	// patterns are only run for pushes, not for pull requests.
+	Branches []string `json:"branches"`
+	Tags     []string `json:"tags"`
+
+	// Label makes the build run on demand, for the pull requests with the
+	// label. It is scheduled when the label is added and rebuilt on pushes
+	// while the label stays. RemoveLabel removes the label again when the
+	// build completed.
+	Label       string `json:"label"`
+	RemoveLabel bool   `json:"remove_label"`
+
+	// TestMerge enables building the commit github creates to test merging
+	// a pull request into its base branch, passed as GIT_MERGE_SHA1 and
+	// GIT_MERGE_REF next to the head of the pull request. The status is
+	// still set on the head.
+	TestMerge bool `json:"test_merge"`
+
+	// Parameters are templates of the parameters the job is started with
+	// by name, see defaultParameters. They are executed with the
+	// parameterData of the pull request.
+	Parameters map[string]string `json:"parameters"`
+
+	// Multibranch describes how the jobs for pull requests and branches
+	// are named if the job is a multibranch pipeline project.
+	Multibranch jenkins.Multibranch `json:"multibranch"`
+
+	// Jenkins is the name of the jenkins master in JenkinsMasters the job
+	// runs on. It is empty for jobs on the default master.
+	Jenkins string `json:"jenkins"`
+
+	// TestReport enables fetching the JUnit test report of completed
+	// builds, to add the test counts to the status and list the failed
+	// tests in the failure comment.
+	TestReport bool `json:"test_report"`
+
+	// RetryFlaky enables rescheduling a failed build once if all the tests
+	// that failed are known to be flaky. Without a test report the failed
+	// tests are found in the log with the first group of TestNamePattern.
+	RetryFlaky      bool   `json:"retry_flaky"`
+	TestNamePattern string `json:"test_name_pattern"`
+
+	// FailureComment enables commenting on the pull request with the
+	// failures found in the log of a failed build.
+	FailureComment bool     `json:"failure_comment"`
+	LogPatterns    []string `json:"log_patterns"`
+	LogContext     int      `json:"log_context"`
+	LogTail        int64    `json:"log_tail"`
+	MaxCommentSize int      `json:"max_comment_size"`
+}
+
+// logFilter returns how failures are extracted from the logs of the build.
+func (b Build) logFilter() jenkins.LogFilter {
+	return jenkins.LogFilter{
+		Patterns: b.LogPatterns,
+		Context:  b.LogContext,
+		MaxSize:  b.MaxCommentSize,
+		Tail:     b.LogTail,
+	}
 }
 
 func init() {
@@ -60,10 +208,11 @@ func init() {
 	flag.StringVar(&keyFile, "key", "", "path to ssl key")
 	flag.StringVar(&port, "port", "80", "port to use")
 	flag.StringVar(&configFile, "config", "/etc/leeroy/config.json", "path to config file")
-	flag.Parse()
 }
 
 func main() {
+	flag.Parse()
+
 	// set log level
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -88,6 +237,80 @@ func main() {
 		logrus.Errorf("error parsing config file as json: %v", err)
 		return
 	}
+	if config.Jenkins == nil && len(config.JenkinsMasters) == 0 {
+		logrus.Errorf("config file does not contain a jenkins section: %s", configFile)
+		return
+	}
+	for _, build := range config.Builds {
+		if _, err := config.getJenkins(build.Jenkins); err != nil {
+			logrus.Errorf("invalid config for job %s: %v", build.Job, err)
+			return
+		}
+		if _, err := build.parameterTemplates(build.isPushBuild()); err != nil {
+			logrus.Errorf("invalid config for job %s: %v", build.Job, err)
+			return
+		}
+		for _, p := range append(build.Branches, build.Tags...) {
+			if _, err := path.Match(p, ""); err != nil {
+				logrus.Errorf("invalid config for job %s: pattern %q: %v", build.Job, p, err)
+				return
+			}
+		}
+	}
+
+	for name, rc := range config.Repos {
+		if rc.RequireApproval && config.GHWebhookSecret == "" {
+			logrus.Errorf("invalid config for repo %s: require_approval needs github_webhook_secret", name)
+			return
+		}
+		if rc.AutoMerge && config.GHWebhookSecret == "" {
+			logrus.Errorf("invalid config for repo %s: automerge needs github_webhook_secret", name)
+			return
+		}
+		switch rc.mergeMethod() {
+		case "merge", "squash", "rebase":
+		default:
+			logrus.Errorf("invalid config for repo %s: unknown merge method %q", name, rc.MergeMethod)
+			return
+		}
+		if rc.MergeQueue != nil {
+			if len(rc.MergeQueue.Contexts) == 0 {
+				logrus.Errorf("invalid config for repo %s: merge queue has no contexts", name)
+				return
+			}
+			for _, context := range rc.MergeQueue.Contexts {
+				if _, err := config.getBuildByContextAndRepo(context, name); err != nil {
+					logrus.Errorf("invalid config for repo %s: merge queue: %v", name, err)
+					return
+				}
+			}
+		}
+	}
+
+	if config.Dispatch != nil {
+		for _, p := range config.Dispatch.ReleaseBranches {
+			if _, err := path.Match(p, ""); err != nil {
+				logrus.Errorf("invalid config for dispatch: pattern %q: %v", p, err)
+				return
+			}
+		}
+	}
+
+	// check on builds jenkins did not tell us about
+	go config.reconcile()
+
+	// run the scheduled tasks
+	schedules, err = newScheduler(config.Schedules)
+	if err != nil {
+		logrus.Errorf("invalid schedules in config: %v", err)
+		return
+	}
+	schedules.start(config)
+
+	// send the queued builds to jenkins
+	if config.Dispatch != nil {
+		go dispatcher.run(config)
+	}
 
 	// create mux server
 	mux := http.NewServeMux()
@@ -110,6 +333,18 @@ func main() {
 	// cron endpoint to reschedule bulk jobs
 	mux.HandleFunc("/build/cron", cronBuildHandler)
 
+	// flaky test leaderboard endpoint
+	mux.HandleFunc("/flaky", flakyHandler)
+
+	// scheduled tasks endpoint
+	mux.HandleFunc("/schedules", schedulesHandler)
+
+	// merge queue endpoint
+	mux.HandleFunc("/merge-queue", mergeQueueHandler)
+
+	// dispatch queue endpoint
+	mux.HandleFunc("/dispatch", dispatchHandler)
+
 	// set up the server
 	server := &http.Server{
 		Addr:    ":" + port,
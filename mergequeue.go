@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/crosbymichael/octokat"
+	"github.com/docker/leeroy/github"
+)
+
+const (
+	// defaultStagingPrefix is prefixed to the name of a base branch to get
+	// the name of its staging branch, if the config does not say otherwise.
+	defaultStagingPrefix = "leeroy/staging/"
+	// defaultBatchSize is the number of pull requests tested together at
+	// most, if the config does not say otherwise.
+	defaultBatchSize = 8
+)
+
+// MergeQueueConfig describes the merge queue of a repository. Pull requests
+// that can be merged enter the queue of their base branch, and are merged in
+// batches: the batch is merged into a staging branch at the tip of the base
+// branch, and the base branch is fast forwarded to the staging branch if the
+// builds for Contexts pass on it. A batch that fails is split in halves that
+// are tested on their own, until the pull request that broke it is found.
+type MergeQueueConfig struct {
+	Contexts      []string `json:"contexts"`
+	StagingPrefix string   `json:"staging_prefix"`
+	BatchSize     int      `json:"batch_size"`
+}
+
+func (mc MergeQueueConfig) stagingBranch(base string) string {
+	if mc.StagingPrefix == "" {
+		return defaultStagingPrefix + base
+	}
+	return mc.StagingPrefix + base
+}
+
+func (mc MergeQueueConfig) batchSize() int {
+	if mc.BatchSize <= 0 {
+		return defaultBatchSize
+	}
+	return mc.BatchSize
+}
+
+// queuedPR is a pull request waiting to be merged.
+type queuedPR struct {
+	Number int       `json:"number"`
+	Sha    string    `json:"sha"`
+	Queued time.Time `json:"queued"`
+}
+
+// stagingBatch is the batch of pull requests being tested together.
+type stagingBatch struct {
+	PRs     []queuedPR `json:"prs"`
+	Sha     string     `json:"sha"`
+	BaseSha string     `json:"base_sha"`
+	Started time.Time  `json:"started"`
+}
+
+// numbers returns the pull requests of the batch, like "#1, #2".
+func (b stagingBatch) numbers() string {
+	var n []string
+	for _, pr := range b.PRs {
+		n = append(n, fmt.Sprintf("#%d", pr.Number))
+	}
+	return strings.Join(n, ", ")
+}
+
+// mergeQueue is the queue of the pull requests against a base branch.
+type mergeQueue struct {
+	Repo   string        `json:"repo"`
+	Base   string        `json:"base"`
+	Queued []queuedPR    `json:"queued"`
+	Batch  *stagingBatch `json:"batch,omitempty"`
+
+	// limit is the size of the next batch while a failed batch is
+	// bisected, or 0.
+	limit int
+	// check asks to look at the builds of the batch, one of them completed.
+	check bool
+	// busy is set while a goroutine processes the queue. It talks to github
+	// without holding mu, so webhooks are not held up, and only one
+	// goroutine does at a time.
+	busy bool
+	mu   sync.Mutex
+}
+
+// position returns the position of a pull request in the queue, starting
+// at 1, 0 if it is being tested and -1 if it is not in the queue.
+func (q *mergeQueue) position(number int) int {
+	if q.Batch != nil {
+		for _, pr := range q.Batch.PRs {
+			if pr.Number == number {
+				return 0
+			}
+		}
+	}
+	for i, pr := range q.Queued {
+		if pr.Number == number {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// requeue puts the pull requests of the batch back at the front of the
+// queue.
+func (q *mergeQueue) requeue() {
+	q.Queued = append(append([]queuedPR{}, q.Batch.PRs...), q.Queued...)
+	q.Batch = nil
+}
+
+// remove removes a pull request from the queue, but not from the batch being
+// tested.
+func (q *mergeQueue) remove(number int) bool {
+	for i, pr := range q.Queued {
+		if pr.Number == number {
+			q.Queued = append(q.Queued[:i], q.Queued[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// mergeQueueStore holds the merge queues by repository and base branch.
+type mergeQueueStore struct {
+	mu     sync.Mutex
+	queues map[string]*mergeQueue
+}
+
+var mergeQueues = &mergeQueueStore{queues: map[string]*mergeQueue{}}
+
+// get returns the queue of a base branch, creating it if needed.
+func (s *mergeQueueStore) get(repo, base string) *mergeQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := repo + ":" + base
+	q, ok := s.queues[key]
+	if !ok {
+		q = &mergeQueue{Repo: repo, Base: base}
+		s.queues[key] = q
+	}
+	return q
+}
+
+// all returns the queues ordered by repository and base branch.
+func (s *mergeQueueStore) all() []*mergeQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for k := range s.queues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var queues []*mergeQueue
+	for _, k := range keys {
+		queues = append(queues, s.queues[k])
+	}
+	return queues
+}
+
+// enqueuePR adds the head of a pull request to the merge queue of its base
+// branch, and returns its position like mergeQueue.position.
+func (c Config) enqueuePR(repoName, base string, number int, sha string) int {
+	q := mergeQueues.get(repoName, base)
+
+	q.mu.Lock()
+	pos := q.position(number)
+	if pos < 0 {
+		q.Queued = append(q.Queued, queuedPR{Number: number, Sha: sha, Queued: time.Now()})
+		pos = len(q.Queued)
+		logrus.Infof("Queued %s#%d for merging into %s", repoName, number, base)
+	}
+	q.mu.Unlock()
+
+	go c.processMergeQueue(q)
+	return pos
+}
+
+// dequeuePR removes a pull request from the merge queues of a repository.
+func (c Config) dequeuePR(repoName string, number int) {
+	for _, q := range mergeQueues.all() {
+		if q.Repo != repoName {
+			continue
+		}
+
+		q.mu.Lock()
+		if q.remove(number) {
+			logrus.Infof("Removed %s#%d from the merge queue of %s", repoName, number, q.Base)
+		}
+		q.mu.Unlock()
+	}
+}
+
+// processMergeQueue tests the next batch of the queue on the staging branch
+// unless a batch is being tested, and merges or bisects the batch being
+// tested once its builds completed. If another goroutine is processing the
+// queue, it picks up the changes instead.
+func (c Config) processMergeQueue(q *mergeQueue) {
+	rc := c.getRepoConfig(q.Repo)
+	if rc.MergeQueue == nil {
+		return
+	}
+	mc := *rc.MergeQueue
+
+	q.mu.Lock()
+	if q.busy {
+		q.mu.Unlock()
+		return
+	}
+	q.busy = true
+	q.mu.Unlock()
+
+	for {
+		q.mu.Lock()
+		switch {
+		case q.Batch != nil && q.check:
+			q.check = false
+			batch := *q.Batch
+			q.mu.Unlock()
+
+			c.finishBatch(q, batch)
+		case q.Batch == nil && len(q.Queued) > 0:
+			size := mc.batchSize()
+			if q.limit > 0 && q.limit < size {
+				size = q.limit
+			}
+			if size > len(q.Queued) {
+				size = len(q.Queued)
+			}
+			candidates := append([]queuedPR{}, q.Queued[:size]...)
+			q.mu.Unlock()
+
+			if !c.stageBatch(q, mc, candidates) {
+				q.mu.Lock()
+				q.busy = false
+				q.mu.Unlock()
+				return
+			}
+		default:
+			q.busy = false
+			q.mu.Unlock()
+			return
+		}
+	}
+}
+
+// stageBatch merges the candidates into the staging branch at the tip of the
+// base branch and schedules the builds of the batch. It returns false if it
+// failed and the queue has to wait for the next event.
+func (c Config) stageBatch(q *mergeQueue, mc MergeQueueConfig, candidates []queuedPR) bool {
+	r := strings.SplitN(q.Repo, "/", 2)
+	if len(r) < 2 {
+		logrus.Errorf("repo name could not be parsed: %s", q.Repo)
+		return false
+	}
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+	staging := mc.stagingBranch(q.Base)
+
+	// start the staging branch at the tip of the base branch
+	baseSha, err := g.BranchSha(repo, q.Base)
+	if err != nil {
+		logrus.Errorf("getting branch %s of %s failed: %v", q.Base, q.Repo, err)
+		return false
+	}
+	if err := g.UpdateBranch(repo, staging, baseSha, true); err != nil {
+		logrus.Errorf("resetting staging branch %s of %s failed: %v", staging, q.Repo, err)
+		return false
+	}
+
+	batch := &stagingBatch{BaseSha: baseSha, Sha: baseSha, Started: time.Now()}
+	for _, pr := range candidates {
+		msg := fmt.Sprintf("Merge pull request #%d into %s", pr.Number, staging)
+		sha, err := g.MergeIntoBranch(repo, staging, pr.Sha, msg)
+		if err == github.ErrMergeConflict {
+			q.mu.Lock()
+			q.remove(pr.Number)
+			q.mu.Unlock()
+			merges.forget(q.Repo, pr.Number)
+			c.setMergeStatus(q.Repo, pr, "failure", fmt.Sprintf("Not merging, the pull request conflicts with %s or the pull requests queued before it", q.Base))
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("merging %s#%d into %s failed: %v", q.Repo, pr.Number, staging, err)
+			return false
+		}
+		batch.PRs = append(batch.PRs, pr)
+		batch.Sha = sha
+	}
+	if len(batch.PRs) == 0 {
+		return true
+	}
+
+	// the pull requests removed from the queue while they were merged into
+	// the staging branch stay in the batch, like the ones removed while it
+	// is tested
+	q.mu.Lock()
+	for _, pr := range batch.PRs {
+		q.remove(pr.Number)
+	}
+	q.Batch = batch
+	q.mu.Unlock()
+
+	// all the builds need to pass on the staging branch
+	summaries.add(q.Repo, batch.Sha, 0, mc.Contexts...)
+	for _, statusContext := range mc.Contexts {
+		build, err := c.getBuildByContextAndRepo(statusContext, q.Repo)
+		if err == nil {
+			err = c.schedulePushBuild(context.Background(), q.Repo, staging, "", batch.Sha, build)
+		}
+		if err != nil {
+			logrus.Errorf("scheduling %s for staging branch %s of %s failed: %v", statusContext, staging, q.Repo, err)
+			q.mu.Lock()
+			q.requeue()
+			q.mu.Unlock()
+			return false
+		}
+	}
+
+	logrus.Infof("Testing %s of %s at %s on %s", batch.numbers(), q.Repo, batch.Sha, staging)
+	for _, pr := range batch.PRs {
+		c.setMergeStatus(q.Repo, pr, "pending", fmt.Sprintf("Testing in the merge queue with %s", batch.numbers()))
+	}
+	return true
+}
+
+// stagingBuildCompleted checks the builds of the batch tested at sha, if
+// there is one. When they all passed the base branch is fast forwarded to
+// the staging branch, and when one failed the batch is bisected.
+func (c Config) stagingBuildCompleted(repoName, sha string) {
+	for _, q := range mergeQueues.all() {
+		if q.Repo != repoName {
+			continue
+		}
+
+		q.mu.Lock()
+		if q.Batch != nil && q.Batch.Sha == sha {
+			q.check = true
+		}
+		q.mu.Unlock()
+
+		go c.processMergeQueue(q)
+	}
+}
+
+// finishBatch merges or bisects the batch being tested once its builds
+// completed. It is called by the goroutine processing the queue.
+func (c Config) finishBatch(q *mergeQueue, batch stagingBatch) {
+	required, states, err := c.requiredStates(q.Repo, batch.Sha)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	state, desc := summarize(required, states)
+
+	switch state {
+	case "pending":
+		return
+	case "success":
+		r := strings.SplitN(q.Repo, "/", 2)
+		g := github.GitHub{
+			AuthToken: c.GHToken,
+			User:      c.GHUser,
+		}
+		repo := octokat.Repo{
+			Name:     r[1],
+			UserName: r[0],
+		}
+
+		// fails if the base branch moved since the batch was staged
+		if err := g.UpdateBranch(repo, q.Base, batch.Sha, false); err != nil {
+			logrus.Errorf("fast forwarding %s of %s to %s failed, testing the batch again: %v", q.Base, q.Repo, batch.Sha, err)
+			q.mu.Lock()
+			q.requeue()
+			q.mu.Unlock()
+			return
+		}
+
+		logrus.Infof("Merged %s of %s into %s at %s", batch.numbers(), q.Repo, q.Base, batch.Sha)
+		q.mu.Lock()
+		q.Batch = nil
+		q.limit = 0
+		q.mu.Unlock()
+		for _, pr := range batch.PRs {
+			merges.forget(q.Repo, pr.Number)
+			c.setMergeStatus(q.Repo, pr, "success", fmt.Sprintf("Merged into %s by the merge queue", q.Base))
+		}
+	default:
+		// the pull request that broke the build is found
+		if len(batch.PRs) == 1 {
+			pr := batch.PRs[0]
+			logrus.Infof("Removing %s#%d from the merge queue of %s: %s", q.Repo, pr.Number, q.Base, desc)
+			q.mu.Lock()
+			q.Batch = nil
+			q.limit = 0
+			q.mu.Unlock()
+			merges.forget(q.Repo, pr.Number)
+			c.setMergeStatus(q.Repo, pr, "failure", "Failed in the merge queue: "+desc)
+			return
+		}
+
+		// test the first half of the batch on its own
+		logrus.Infof("Batch %s of %s failed, bisecting it: %s", batch.numbers(), q.Repo, desc)
+		q.mu.Lock()
+		q.limit = len(batch.PRs) / 2
+		q.requeue()
+		q.mu.Unlock()
+	}
+}
+
+// setMergeStatus sets the status saying what a pull request in the merge
+// queue waits for.
+func (c Config) setMergeStatus(repoName string, pr queuedPR, state, desc string) {
+	url := fmt.Sprintf("https://github.com/%s/pull/%d", repoName, pr.Number)
+	if err := c.updateGithubStatus(repoName, c.getRepoConfig(repoName).autoMergeContext(), pr.Sha, state, desc, url); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func mergeQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		logrus.Errorf("%q is not a valid method", r.Method)
+		w.WriteHeader(405)
+		return
+	}
+
+	queues := []*mergeQueue{}
+	for _, q := range mergeQueues.all() {
+		q.mu.Lock()
+		snapshot := &mergeQueue{
+			Repo:   q.Repo,
+			Base:   q.Base,
+			Queued: append([]queuedPR{}, q.Queued...),
+		}
+		if q.Batch != nil {
+			batch := *q.Batch
+			snapshot.Batch = &batch
+		}
+		q.mu.Unlock()
+		queues = append(queues, snapshot)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(queues); err != nil {
+		logrus.Errorf("encoding the merge queues as json failed: %v", err)
+	}
+}
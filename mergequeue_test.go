@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func queuedNumbers(prs []queuedPR) (n []int) {
+	for _, pr := range prs {
+		n = append(n, pr.Number)
+	}
+	return n
+}
+
+func TestMergeQueue(t *testing.T) {
+	q := &mergeQueue{
+		Queued: []queuedPR{{Number: 3}, {Number: 4}},
+		Batch:  &stagingBatch{PRs: []queuedPR{{Number: 1}, {Number: 2}}},
+	}
+
+	for number, expected := range map[int]int{1: 0, 2: 0, 3: 1, 4: 2, 5: -1} {
+		if pos := q.position(number); pos != expected {
+			t.Fatalf("expected #%d to be at position %d, was %d", number, expected, pos)
+		}
+	}
+
+	// the pull requests being tested are not removed
+	if q.remove(1) {
+		t.Fatal("expected #1 of the batch not to be removed")
+	}
+	if !q.remove(3) {
+		t.Fatal("expected #3 to be removed")
+	}
+
+	q.requeue()
+	if q.Batch != nil {
+		t.Fatalf("expected no batch after requeueing, was %#v", q.Batch)
+	}
+	if n, expected := queuedNumbers(q.Queued), []int{1, 2, 4}; !reflect.DeepEqual(n, expected) {
+		t.Fatalf("expected the queue to be %v, was %v", expected, n)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/crosbymichael/octokat"
+	"github.com/docker/leeroy/github"
+)
+
+// defaultParameters are the templates of the parameters every build is
+// started with. Builds can override them, add more, or drop them by setting
+// an empty template.
+var defaultParameters = map[string]string{
+	"GIT_BASE_REPO": "{{.BaseRepo}}",
+	"GIT_HEAD_REPO": "{{.HeadRepo}}",
+	"GIT_SHA1":      "{{.Sha}}",
+	"GITHUB_URL":    "{{.URL}}",
+	"PR":            "{{.Number}}",
+	"BASE_BRANCH":   "{{.BaseRef}}",
+}
+
+// pushParameters are the templates of the parameters builds of pushed
+// branches and tags are started with.
+var pushParameters = map[string]string{
+	"GIT_BASE_REPO": "{{.BaseRepo}}",
+	"GIT_HEAD_REPO": "{{.HeadRepo}}",
+	"GIT_SHA1":      "{{.Sha}}",
+	"GITHUB_URL":    "{{.URL}}",
+	"BRANCH":        "{{.Branch}}",
+	"TAG":           "{{.Tag}}",
+}
+
+// mergeParameters are added to the default parameters of builds that test
+// the merge commit of pull requests.
+var mergeParameters = map[string]string{
+	"GIT_MERGE_SHA1": "{{.MergeSha}}",
+	"GIT_MERGE_REF":  "{{.MergeRef}}",
+	"GIT_BASE_SHA1":  "{{.BaseSha}}",
+}
+
+// parameterFuncs are the functions available in parameter templates.
+var parameterFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// parameterData is what the parameter templates of a build are executed
+// with. The labels, merge commit and changed files of the pull request are
+// only requested from github if a template uses them. For builds of pushed
+// branches and tags Number is 0.
+type parameterData struct {
+	BaseRepo string
+	HeadRepo string
+	Sha      string
+	URL      string
+	Number   int
+	Title    string
+	Body     string
+	Author   string
+	HeadRef  string
+	BaseRef  string
+	MergeRef string
+	Branch   string
+	Tag      string
+
+	c       Config
+	repo    octokat.Repo
+	baseSha string
+	labels  []string
+	files   []string
+	details *github.PullRequestDetails
+	merge   *github.TestMergeCommit
+}
+
+func newParameterData(c Config, baseRepo, sha string, pr *octokat.PullRequest) *parameterData {
+	r := strings.SplitN(baseRepo, "/", 2)
+	return &parameterData{
+		BaseRepo: baseRepo,
+		HeadRepo: fmt.Sprintf("%s/%s", pr.Head.Repo.Owner.Login, pr.Head.Repo.Name),
+		Sha:      sha,
+		URL:      fmt.Sprintf("https://github.com/%s/pull/%d", baseRepo, pr.Number),
+		Number:   pr.Number,
+		Title:    pr.Title,
+		Body:     pr.Body,
+		Author:   pr.User.Login,
+		HeadRef:  pr.Head.Ref,
+		BaseRef:  pr.Base.Ref,
+		MergeRef: fmt.Sprintf("refs/pull/%d/merge", pr.Number),
+
+		c:       c,
+		repo:    octokat.Repo{Name: r[1], UserName: r[0]},
+		baseSha: pr.Base.Sha,
+	}
+}
+
+// newPushParameterData returns the data for the build of a commit pushed to
+// a branch or tag.
+func newPushParameterData(c Config, repoName, sha, branch, tag string) *parameterData {
+	r := strings.SplitN(repoName, "/", 2)
+	return &parameterData{
+		BaseRepo: repoName,
+		HeadRepo: repoName,
+		Sha:      sha,
+		URL:      fmt.Sprintf("https://github.com/%s/commit/%s", repoName, sha),
+		Branch:   branch,
+		Tag:      tag,
+
+		c:    c,
+		repo: octokat.Repo{Name: r[1], UserName: r[0]},
+	}
+}
+
+// Labels returns the names of the labels of the pull request.
+func (d *parameterData) Labels() ([]string, error) {
+	if d.labels != nil {
+		return d.labels, nil
+	}
+
+	details, err := d.pullRequestDetails()
+	if err != nil {
+		return nil, err
+	}
+
+	d.labels = []string{}
+	for _, l := range details.Labels {
+		d.labels = append(d.labels, l.Name)
+	}
+	sort.Strings(d.labels)
+
+	return d.labels, nil
+}
+
+// MergeSha returns the sha of the commit github created to test merging the
+// pull request into its base branch.
+func (d *parameterData) MergeSha() (string, error) {
+	if d.merge != nil {
+		return d.merge.Sha, nil
+	}
+
+	details, err := d.pullRequestDetails()
+	if err != nil {
+		return "", err
+	}
+
+	return details.MergeCommitSha, nil
+}
+
+// BaseSha returns the sha of the base branch the pull request is tested
+// against.
+func (d *parameterData) BaseSha() string {
+	if d.merge != nil {
+		return d.merge.BaseSha
+	}
+
+	return d.baseSha
+}
+
+// Files returns the names of the files the pull request changes.
+func (d *parameterData) Files() ([]string, error) {
+	if d.files != nil {
+		return d.files, nil
+	}
+	if d.Number == 0 {
+		return nil, fmt.Errorf("the build of %s is not for a pull request", d.Sha)
+	}
+
+	gh := octokat.NewClient()
+	gh = gh.WithToken(d.c.GHToken)
+	files := []string{}
+	// github lists the files 100 at a time, request the next page until
+	// one comes back short
+	for page := 1; ; page++ {
+		fs, err := gh.PullRequestFiles(d.repo, strconv.Itoa(d.Number), &octokat.Options{
+			QueryParams: map[string]string{
+				"per_page": "100",
+				"page":     strconv.Itoa(page),
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("getting files of pull request %d for %s failed: %v", d.Number, d.BaseRepo, err)
+		}
+
+		for _, f := range fs {
+			files = append(files, f.FileName)
+		}
+		if len(fs) < 100 {
+			break
+		}
+	}
+
+	d.files = files
+	return d.files, nil
+}
+
+func (d *parameterData) pullRequestDetails() (*github.PullRequestDetails, error) {
+	if d.details != nil {
+		return d.details, nil
+	}
+	if d.Number == 0 {
+		return nil, fmt.Errorf("the build of %s is not for a pull request", d.Sha)
+	}
+
+	g := github.GitHub{
+		AuthToken: d.c.GHToken,
+		User:      d.c.GHUser,
+	}
+	details, err := g.GetPullRequestDetails(d.repo, d.Number)
+	if err != nil {
+		return nil, fmt.Errorf("getting pull request %d for %s failed: %v", d.Number, d.BaseRepo, err)
+	}
+	d.details = details
+
+	return details, nil
+}
+
+// parameterTemplates returns the parsed templates of the parameters of the
+// build, which are the default ones with the ones of the build applied. The
+// defaults for builds of pushed branches and tags are pushParameters.
+func (b Build) parameterTemplates(push bool) (map[string]*template.Template, error) {
+	defaults := defaultParameters
+	if push {
+		defaults = pushParameters
+	}
+
+	params := map[string]string{}
+	for name, text := range defaults {
+		params[name] = text
+	}
+	if b.TestMerge && !push {
+		for name, text := range mergeParameters {
+			params[name] = text
+		}
+	}
+	for name, text := range b.Parameters {
+		if text == "" {
+			delete(params, name)
+			continue
+		}
+		params[name] = text
+	}
+
+	templates := map[string]*template.Template{}
+	for name, text := range params {
+		t, err := template.New(name).Funcs(parameterFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template of parameter %s failed: %v", name, err)
+		}
+		templates[name] = t
+	}
+
+	return templates, nil
+}
+
+// buildParameters returns the url encoded parameters to start the build
+// with.
+func (b Build) buildParameters(data *parameterData) (string, error) {
+	templates, err := b.parameterTemplates(data.Number == 0)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	for name, t := range templates {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("executing template of parameter %s for job %s failed: %v", name, b.Job, err)
+		}
+		params.Set(name, buf.String())
+	}
+
+	return params.Encode(), nil
+}
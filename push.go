@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/crosbymichael/octokat"
+	"github.com/docker/leeroy/github"
+)
+
+const (
+	// basePushNone leaves the pull requests alone when their base branch
+	// moves. It is the default.
+	basePushNone = "none"
+	// basePushStale sets the successful statuses of the pull requests to
+	// pending, so they are rebuilt before they are merged.
+	basePushStale = "stale"
+	// basePushRebuild rebuilds all the pull requests.
+	basePushRebuild = "rebuild"
+	// basePushOverlap rebuilds the pull requests that change files in the
+	// same directories as the push.
+	basePushOverlap = "overlap"
+
+	// defaultRebuildInterval is the time between scheduling the rebuilds of
+	// pull requests of a repository if the config does not say otherwise.
+	defaultRebuildInterval = 30 * time.Second
+)
+
+func handlePush(w http.ResponseWriter, r *http.Request) {
+	hook, err := github.ParsePushHook(r.Body)
+	if err != nil {
+		logrus.Errorf("Error parsing push hook: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	logrus.Infof("Received GitHub push notification for %s %s: %s", hook.Repo.FullName, hook.Ref, hook.After)
+
+	// tags are built when the create hook for them is received
+	branch := hook.Branch()
+	if branch == "" || hook.Deleted {
+		logrus.Debugf("Ignoring push to %s", hook.Ref)
+		return
+	}
+
+	// schedule the jenkins builds for the branch
+	for _, build := range config.getPushBuilds(hook.Repo.FullName, branch, "") {
+		if err := config.schedulePushBuild(context.Background(), hook.Repo.FullName, branch, "", hook.After, build); err != nil {
+			logrus.Error(err)
+			w.WriteHeader(500)
+		}
+	}
+
+	rc := config.getRepoConfig(hook.Repo.FullName)
+	if rc.BasePushPolicy == "" || rc.BasePushPolicy == basePushNone || !rc.isBaseBranch(branch) {
+		return
+	}
+
+	// looking at all the open pull requests takes a while, so do not keep
+	// github waiting
+	go config.handleBasePush(hook, rc)
+
+	return
+}
+
+func handleCreate(w http.ResponseWriter, r *http.Request) {
+	hook, err := github.ParseCreateHook(r.Body)
+	if err != nil {
+		logrus.Errorf("Error parsing create hook: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	logrus.Infof("Received GitHub create notification for %s %s: %s", hook.Repo.FullName, hook.RefType, hook.Ref)
+
+	// branches are built when the push hook for them is received
+	tag := hook.Tag()
+	if tag == "" {
+		logrus.Debugf("Ignoring created %s %s", hook.RefType, hook.Ref)
+		return
+	}
+
+	builds := config.getPushBuilds(hook.Repo.FullName, "", tag)
+	if len(builds) == 0 {
+		return
+	}
+
+	// the hook does not say which commit was tagged
+	nwo := strings.SplitN(hook.Repo.FullName, "/", 2)
+	if len(nwo) < 2 {
+		logrus.Errorf("repo name could not be parsed: %s", hook.Repo.FullName)
+		w.WriteHeader(500)
+		return
+	}
+	gh := octokat.NewClient()
+	gh = gh.WithToken(config.GHToken)
+	repo := octokat.Repo{
+		Name:     nwo[1],
+		UserName: nwo[0],
+	}
+	commit, err := gh.Commit(repo, tag, &octokat.Options{})
+	if err != nil {
+		logrus.Errorf("getting tag %s for %s failed: %v", tag, hook.Repo.FullName, err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// schedule the jenkins builds for the tag
+	for _, build := range builds {
+		if err := config.schedulePushBuild(context.Background(), hook.Repo.FullName, "", tag, commit.Sha, build); err != nil {
+			logrus.Error(err)
+			w.WriteHeader(500)
+		}
+	}
+
+	return
+}
+
+// schedulePushBuild schedules the build of a commit pushed to a branch or
+// tag, setting the status on the commit.
+func (c Config) schedulePushBuild(ctx context.Context, repoName, branch, tag, sha string, build Build) error {
+	// make sure we even want to build
+	if build.Job == "" {
+		return nil
+	}
+
+	// setup the jenkins client
+	j, err := c.getJenkins(build.Jenkins)
+	if err != nil {
+		return err
+	}
+
+	ref := branch
+	if tag != "" {
+		ref = tag
+	}
+
+	// Pipeline builds set their own status and have their own queue per branch/tag.
+	if build.IsPipeline {
+		if err := j.BuildPipeline(ctx, build.Job, build.Multibranch.SubJob(0, ref)); err != nil {
+			return fmt.Errorf("scheduling jenkins pipeline build failed with: %v", err)
+		}
+		return nil
+	}
+
+	// update the github status
+	if err := c.updateGithubStatus(repoName, build.Context, sha, "pending", "Jenkins build is being scheduled", j.Baseurl); err != nil {
+		return err
+	}
+
+	// setup the parameters
+	parameters, err := build.buildParameters(newPushParameterData(c, repoName, sha, branch, tag))
+	if err != nil {
+		return err
+	}
+	start := func(ctx context.Context) error {
+		q, err := j.BuildWithParameters(ctx, build.Job, parameters)
+		if err != nil {
+			return fmt.Errorf("scheduling jenkins build failed: %v", err)
+		}
+		logrus.Infof("Scheduled job %s for %s %s of %s at %s", build.Job, build.Context, ref, repoName, sha)
+
+		// remember the queue item so we can find the build later on
+		tracker.add(trackedBuild{
+			Repo:    repoName,
+			Sha:     sha,
+			Job:     build.Job,
+			Jenkins: build.Jenkins,
+			Context: build.Context,
+			QueueID: q.ID,
+			State:   "pending",
+		})
+		go c.followQueueItem(j, repoName, sha, build, q)
+		return nil
+	}
+
+	// send the build to jenkins once it fits under the limits
+	return c.dispatch(ctx, dispatchItem{
+		Repo:    repoName,
+		Sha:     sha,
+		Branch:  branch,
+		Job:     build.Job,
+		Jenkins: build.Jenkins,
+		start:   start,
+	})
+}
+
+// handleBasePush applies the policy of a repository to the open pull requests
+// against a branch that was pushed to.
+func (c Config) handleBasePush(hook github.PushHook, rc RepoConfig) {
+	repoName, branch := hook.Repo.FullName, hook.Branch()
+
+	prs, err := c.getOpenPRs(repoName, branch)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if len(prs) == 0 {
+		return
+	}
+
+	switch rc.BasePushPolicy {
+	case basePushStale:
+		c.markPRsStale(hook, prs)
+	case basePushRebuild:
+		var nums []int
+		for _, pr := range prs {
+			nums = append(nums, pr.Number)
+		}
+		rebuilds.add(c, repoName, nums, rc.rebuildInterval())
+	case basePushOverlap:
+		nums, err := c.getOverlappingPRs(hook, prs)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		rebuilds.add(c, repoName, nums, rc.rebuildInterval())
+	default:
+		logrus.Errorf("Unknown base push policy %q for %s", rc.BasePushPolicy, repoName)
+	}
+}
+
+// getOpenPRs returns the open pull requests of a repository against a branch.
+func (c Config) getOpenPRs(repoName, base string) (prs []octokat.PullRequest, err error) {
+	// parse git repo for username
+	// and repo name
+	r := strings.SplitN(repoName, "/", 2)
+	if len(r) < 2 {
+		return prs, fmt.Errorf("repo name could not be parsed: %s", repoName)
+	}
+
+	// initialize github client
+	gh := octokat.NewClient()
+	gh = gh.WithToken(c.GHToken)
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	// get pull requests, github lists them 100 at a time so request the next
+	// page until one comes back short
+	for page := 1; ; page++ {
+		all, err := gh.PullRequests(repo, &octokat.Options{
+			Params: map[string]string{
+				"state": "open",
+				"base":  base,
+			},
+			QueryParams: map[string]string{
+				"per_page": "100",
+				"page":     strconv.Itoa(page),
+			},
+		})
+		if err != nil {
+			return prs, fmt.Errorf("requesting open pull requests against %s for %s failed: %v", base, repoName, err)
+		}
+
+		for _, pr := range all {
+			if pr.Base.Ref == base {
+				prs = append(prs, pr)
+			}
+		}
+		if len(all) < 100 {
+			break
+		}
+	}
+
+	return prs, nil
+}
+
+// markPRsStale sets the successful statuses of pull requests to pending,
+// since they were built against an older base.
+func (c Config) markPRsStale(hook github.PushHook, prs []octokat.PullRequest) {
+	repoName := hook.Repo.FullName
+	builds, err := c.getBuilds(repoName, false, false)
+	if err != nil {
+		logrus.Warn(err)
+		return
+	}
+
+	r := strings.SplitN(repoName, "/", 2)
+	if len(r) < 2 {
+		logrus.Errorf("repo name could not be parsed: %s", repoName)
+		return
+	}
+	gh := octokat.NewClient()
+	gh = gh.WithToken(c.GHToken)
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	desc := fmt.Sprintf("%s moved to %s, rebuild before merging", hook.Branch(), shortSha(hook.After))
+	url := fmt.Sprintf("https://github.com/%s/compare/%s...%s", repoName, shortSha(hook.Before), shortSha(hook.After))
+	for _, pr := range prs {
+		// drafts and work in progress keep their deferred statuses
+		held, err := c.holdPRBuilds(repoName, pr.Number)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if held {
+			continue
+		}
+
+		for _, build := range builds {
+			if !hasStatus(gh, repo, pr.Head.Sha, build.Context) {
+				continue
+			}
+			if err := c.updateGithubStatus(repoName, build.Context, pr.Head.Sha, "pending", desc, url); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+// getOverlappingPRs returns the numbers of the pull requests that change files
+// in the directories the push changed files in. All the pull requests are
+// returned if the push does not list all the files it changed.
+func (c Config) getOverlappingPRs(hook github.PushHook, prs []octokat.PullRequest) (nums []int, err error) {
+	files, ok := hook.Files()
+	if !ok {
+		for _, pr := range prs {
+			nums = append(nums, pr.Number)
+		}
+		return nums, nil
+	}
+
+	dirs := map[string]bool{}
+	for _, f := range files {
+		dirs[path.Dir(f)] = true
+	}
+
+	repoName := hook.Repo.FullName
+	r := strings.SplitN(repoName, "/", 2)
+	if len(r) < 2 {
+		return nums, fmt.Errorf("repo name could not be parsed: %s", repoName)
+	}
+	gh := octokat.NewClient()
+	gh = gh.WithToken(c.GHToken)
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	for _, pr := range prs {
+		overlaps, err := prOverlaps(gh, repo, pr.Number, dirs)
+		if err != nil {
+			return nums, fmt.Errorf("getting files of pull request %d for %s failed: %v", pr.Number, repoName, err)
+		}
+		if overlaps {
+			nums = append(nums, pr.Number)
+		}
+	}
+
+	logrus.Infof("Push to %s of %s overlaps with pull requests %v", hook.Branch(), repoName, nums)
+	return nums, nil
+}
+
+// prOverlaps returns if a pull request changes files in one of the
+// directories. github lists the files 100 at a time, so the next page is
+// requested until one comes back short.
+func prOverlaps(gh *octokat.Client, repo octokat.Repo, number int, dirs map[string]bool) (bool, error) {
+	for page := 1; ; page++ {
+		files, err := gh.PullRequestFiles(repo, strconv.Itoa(number), &octokat.Options{
+			QueryParams: map[string]string{
+				"per_page": "100",
+				"page":     strconv.Itoa(page),
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+
+		for _, f := range files {
+			if dirs[path.Dir(f.FileName)] {
+				return true, nil
+			}
+		}
+		if len(files) < 100 {
+			return false, nil
+		}
+	}
+}
+
+// rebuildQueue schedules the builds of pull requests of a repository one at a
+// time, so a moving base branch does not flood jenkins.
+type rebuildQueue struct {
+	mu      sync.Mutex
+	queued  map[string][]int // repo -> pull request numbers
+	running map[string]bool
+}
+
+var rebuilds = &rebuildQueue{
+	queued:  map[string][]int{},
+	running: map[string]bool{},
+}
+
+// add queues the pull requests of a repository that are not queued yet, and
+// starts scheduling them if that is not happening already.
+func (q *rebuildQueue) add(c Config, repoName string, nums []int, interval time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued := map[int]bool{}
+	for _, n := range q.queued[repoName] {
+		queued[n] = true
+	}
+	for _, n := range nums {
+		if !queued[n] {
+			queued[n] = true
+			q.queued[repoName] = append(q.queued[repoName], n)
+		}
+	}
+
+	if !q.running[repoName] && len(q.queued[repoName]) > 0 {
+		q.running[repoName] = true
+		go q.run(c, repoName, interval)
+	}
+}
+
+// next returns the next pull request to rebuild for a repository, or false
+// if there is none left.
+func (q *rebuildQueue) next(repoName string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.queued[repoName]) == 0 {
+		delete(q.queued, repoName)
+		q.running[repoName] = false
+		return 0, false
+	}
+
+	n := q.queued[repoName][0]
+	q.queued[repoName] = q.queued[repoName][1:]
+	return n, true
+}
+
+func (q *rebuildQueue) run(c Config, repoName string, interval time.Duration) {
+	for {
+		n, ok := q.next(repoName)
+		if !ok {
+			return
+		}
+
+		builds, err := c.getBuilds(repoName, false, false)
+		if err != nil {
+			logrus.Warn(err)
+			continue
+		}
+
+		// drafts and work in progress are not rebuilt
+		held, err := c.holdPRBuilds(repoName, n)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if held {
+			continue
+		}
+
+		logrus.Infof("Rebuilding %s#%d after its base branch moved", repoName, n)
+		for _, build := range builds {
+			if err := c.scheduleJenkinsBuild(context.Background(), repoName, n, "", build); err != nil {
+				logrus.Error(err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRebuildQueueAdd(t *testing.T) {
+	q := &rebuildQueue{
+		queued: map[string][]int{},
+		// pretend the queue is already being worked on so add does not
+		// start scheduling builds
+		running: map[string]bool{"docker/docker": true},
+	}
+
+	q.add(Config{}, "docker/docker", []int{1, 2, 1}, 0)
+	q.add(Config{}, "docker/docker", []int{2, 3}, 0)
+	if expected := []int{1, 2, 3}; !reflect.DeepEqual(q.queued["docker/docker"], expected) {
+		t.Fatalf("expected the queue to be %v, was %v", expected, q.queued["docker/docker"])
+	}
+
+	// a pull request can be queued again once it was taken off the queue
+	if n, ok := q.next("docker/docker"); !ok || n != 1 {
+		t.Fatalf("expected pull request 1 to be next, was %d", n)
+	}
+	q.add(Config{}, "docker/docker", []int{1}, 0)
+	if expected := []int{2, 3, 1}; !reflect.DeepEqual(q.queued["docker/docker"], expected) {
+		t.Fatalf("expected the queue to be %v, was %v", expected, q.queued["docker/docker"])
+	}
+}
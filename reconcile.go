@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/leeroy/jenkins"
+)
+
+const (
+	// defaultReconcileInterval is how often builds are reconciled if the
+	// config does not say otherwise.
+	defaultReconcileInterval = 5 * time.Minute
+
+	// defaultReconcileMaxAge is how long a build may take to report back if
+	// the config does not say otherwise.
+	defaultReconcileMaxAge = 6 * time.Hour
+)
+
+// reconcile periodically looks up the builds leeroy still has a pending
+// status for in jenkins and sets the final status for the ones that
+// completed without the notification reaching leeroy. Setting the reconcile
+// interval to a negative value disables it.
+func (c Config) reconcile() {
+	if c.ReconcileInterval < 0 {
+		return
+	}
+
+	interval, maxAge := c.reconcileInterval(), c.reconcileMaxAge()
+	for range time.Tick(interval) {
+		c.reconcilePending(context.Background(), interval, maxAge)
+	}
+}
+
+// reconcileInterval returns how often builds are reconciled, which is also
+// how long a pending build goes without updates before it is checked.
+func (c Config) reconcileInterval() time.Duration {
+	if c.ReconcileInterval > 0 {
+		return time.Duration(c.ReconcileInterval) * time.Second
+	}
+	return defaultReconcileInterval
+}
+
+// reconcileMaxAge returns how long a build may take to report back.
+func (c Config) reconcileMaxAge() time.Duration {
+	if c.ReconcileMaxAge > 0 {
+		return time.Duration(c.ReconcileMaxAge) * time.Second
+	}
+	return defaultReconcileMaxAge
+}
+
+// reconcilePending checks the pending builds that have not been updated for
+// at least the grace period.
+func (c Config) reconcilePending(ctx context.Context, grace, maxAge time.Duration) {
+	// group the builds by job so we only ask jenkins once per job
+	type masterJob struct {
+		jenkins, job string
+	}
+	jobs := map[masterJob][]trackedBuild{}
+	for _, b := range tracker.pending() {
+		if time.Since(b.Updated) >= grace {
+			key := masterJob{b.Jenkins, b.Job}
+			jobs[key] = append(jobs[key], b)
+		}
+	}
+
+	for key, pending := range jobs {
+		job := key.job
+		j, err := c.getJenkins(key.jenkins)
+		if err != nil {
+			logrus.Warnf("Reconciling builds for job %s failed: %v", job, err)
+			continue
+		}
+
+		builds, err := j.GetBuilds(ctx, job)
+		if err != nil {
+			logrus.Warnf("Reconciling builds for job %s failed: %v", job, err)
+			continue
+		}
+
+		for _, t := range pending {
+			if b := findRecentBuild(builds, t); b != nil && !b.Building && b.Result != "" {
+				c.reconcileBuild(t, b)
+				continue
+			}
+
+			// give up on builds that are stuck
+			if time.Since(t.Scheduled) > maxAge {
+				desc := fmt.Sprintf("Jenkins build %s did not complete within %s", job, maxAge)
+				url := t.URL
+				if url == "" {
+					url = j.Baseurl
+				}
+				if err := c.updateGithubStatus(t.Repo, t.Context, t.Sha, "error", desc, url); err != nil {
+					logrus.Error(err)
+					continue
+				}
+				tracker.update(t.Sha, t.Jenkins, t.Job, func(b *trackedBuild) {
+					b.State = "error"
+				})
+				c.buildCompleted(t.Repo, t.Sha, t.PR)
+			}
+		}
+	}
+}
+
+// reconcileBuild sets the status for a tracked build jenkins reports as
+// completed.
+func (c Config) reconcileBuild(t trackedBuild, b *jenkins.RecentBuild) {
+	state, desc, err := buildResultStatus(t.Job, b.Number, b.Result)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	desc = withBaseSha(desc, t.BaseSha)
+
+	logrus.Infof("Reconciling build %s %d for %s which completed with %s after %s", t.Job, b.Number, t.Sha, b.Result, time.Duration(b.Duration)*time.Millisecond)
+	if err := c.updateGithubStatus(t.Repo, t.Context, t.Sha, state, desc, b.URL+"console"); err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	tracker.update(t.Sha, t.Jenkins, t.Job, func(tb *trackedBuild) {
+		tb.Number = b.Number
+		tb.URL = b.URL
+		tb.State = state
+	})
+
+	c.buildCompleted(t.Repo, t.Sha, t.PR)
+}
+
+// findRecentBuild returns the jenkins build for a tracked build, matching on
+// the build number, the queue item or, failing those, the commit the build
+// was started for.
+func findRecentBuild(builds []jenkins.RecentBuild, t trackedBuild) *jenkins.RecentBuild {
+	for i, b := range builds {
+		if (t.Number != 0 && b.Number == t.Number) || (t.QueueID != 0 && b.QueueID == t.QueueID) {
+			return &builds[i]
+		}
+	}
+
+	// older versions of jenkins do not expose the queue item of a build;
+	// the builds are ordered from newest to oldest, so this is the latest
+	// build for the commit
+	if t.Number == 0 {
+		for i, b := range builds {
+			if b.QueueID == 0 && b.Parameter("GIT_SHA1") == t.Sha {
+				return &builds[i]
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/crosbymichael/octokat"
+	"github.com/docker/leeroy/cron"
+)
+
+const (
+	// taskRebuildFailed rebuilds the open pull requests of a repository
+	// without a successful status for the context.
+	taskRebuildFailed = "rebuild_failed"
+	// taskBranchBuild builds the head of a branch.
+	taskBranchBuild = "branch_build"
+	// taskStaleSweep sets the final status of builds whose notifications
+	// never reached leeroy, see reconcilePending.
+	taskStaleSweep = "stale_sweep"
+)
+
+// ScheduleConfig describes a task leeroy runs periodically
+type ScheduleConfig struct {
+	Name    string `json:"name"`
+	Cron    string `json:"cron"`
+	Task    string `json:"task"`
+	Repo    string `json:"github_repo"`
+	Context string `json:"context"`
+	Branch  string `json:"branch"`
+	// Jitter is the maximum number of seconds a run is delayed by, so
+	// tasks with the same schedule do not all start at once.
+	Jitter int `json:"jitter"`
+}
+
+// scheduledTask is a task with its schedule and the outcome of its last run.
+type scheduledTask struct {
+	ScheduleConfig
+	schedule *cron.Schedule
+
+	mu           sync.Mutex
+	running      bool
+	next         time.Time
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastOutcome  string
+}
+
+// taskStatus describes a scheduled task for the listing endpoint.
+type taskStatus struct {
+	ScheduleConfig
+	Running      bool      `json:"running"`
+	NextRun      time.Time `json:"next_run"`
+	LastRun      time.Time `json:"last_run,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastOutcome  string    `json:"last_outcome,omitempty"`
+}
+
+// scheduler runs the scheduled tasks.
+type scheduler struct {
+	tasks []*scheduledTask
+}
+
+var schedules = &scheduler{}
+
+// newScheduler parses the schedules of the config.
+func newScheduler(configs []ScheduleConfig) (*scheduler, error) {
+	s := &scheduler{}
+	for _, sc := range configs {
+		switch sc.Task {
+		case taskRebuildFailed, taskBranchBuild:
+			if sc.Repo == "" {
+				return nil, fmt.Errorf("schedule %q for task %s has no repo", sc.Cron, sc.Task)
+			}
+		case taskStaleSweep:
+		default:
+			return nil, fmt.Errorf("schedule %q has unknown task %q", sc.Cron, sc.Task)
+		}
+		if sc.Task == taskBranchBuild && sc.Branch == "" {
+			return nil, fmt.Errorf("schedule %q for task %s has no branch", sc.Cron, sc.Task)
+		}
+
+		schedule, err := cron.Parse(sc.Cron)
+		if err != nil {
+			return nil, err
+		}
+
+		if sc.Name == "" {
+			sc.Name = strings.Join(nonEmpty(sc.Task, sc.Repo, sc.Context, sc.Branch), " ")
+		}
+		s.tasks = append(s.tasks, &scheduledTask{
+			ScheduleConfig: sc,
+			schedule:       schedule,
+		})
+	}
+
+	return s, nil
+}
+
+// nonEmpty returns the strings that are not empty.
+func nonEmpty(s ...string) (r []string) {
+	for _, v := range s {
+		if v != "" {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// start runs each task on its schedule.
+func (s *scheduler) start(c Config) {
+	for _, t := range s.tasks {
+		go t.loop(c)
+	}
+}
+
+// loop waits for the next time the task is scheduled for and runs it, unless
+// the previous run is still going.
+func (t *scheduledTask) loop(c Config) {
+	for {
+		next := t.schedule.Next(time.Now())
+		if next.IsZero() {
+			logrus.Warnf("Schedule %q of task %s never matches", t.Cron, t.Name)
+			return
+		}
+		t.mu.Lock()
+		t.next = next
+		t.mu.Unlock()
+
+		delay := time.Until(next)
+		if t.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(t.Jitter) * int64(time.Second)))
+		}
+		time.Sleep(delay)
+
+		t.mu.Lock()
+		if t.running {
+			t.lastOutcome = "skipped, the previous run is still running"
+			t.mu.Unlock()
+			logrus.Warnf("Skipping scheduled task %s, the previous run is still running", t.Name)
+			continue
+		}
+		t.running = true
+		t.mu.Unlock()
+
+		go t.run(c)
+	}
+}
+
+// run runs the task once and records the outcome.
+func (t *scheduledTask) run(c Config) {
+	start := time.Now()
+	logrus.Infof("Running scheduled task %s", t.Name)
+
+	outcome := "success"
+	if err := c.runTask(withPriority(context.Background(), priorityCron), t.ScheduleConfig); err != nil {
+		logrus.Errorf("Scheduled task %s failed: %v", t.Name, err)
+		outcome = "failed: " + err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running = false
+	t.lastRun = start
+	t.lastDuration = time.Since(start)
+	t.lastOutcome = outcome
+}
+
+// status returns the schedule and the outcome of the last run of the task.
+func (t *scheduledTask) status() taskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := taskStatus{
+		ScheduleConfig: t.ScheduleConfig,
+		Running:        t.running,
+		NextRun:        t.next,
+		LastRun:        t.lastRun,
+		LastOutcome:    t.lastOutcome,
+	}
+	if !t.lastRun.IsZero() {
+		s.LastDuration = t.lastDuration.String()
+	}
+	return s
+}
+
+// runTask runs a scheduled task.
+func (c Config) runTask(ctx context.Context, sc ScheduleConfig) error {
+	switch sc.Task {
+	case taskRebuildFailed:
+		_, err := c.rebuildFailedPRs(ctx, sc.Repo, sc.Context)
+		return err
+	case taskBranchBuild:
+		return c.buildBranch(ctx, sc.Repo, sc.Context, sc.Branch)
+	case taskStaleSweep:
+		// sweep all the pending builds that have not been updated for a while
+		c.reconcilePending(ctx, c.reconcileInterval(), c.reconcileMaxAge())
+		return nil
+	}
+
+	return fmt.Errorf("unknown task %q", sc.Task)
+}
+
+// rebuildFailedPRs schedules the build for a context of the open pull
+// requests of a repository that do not have a successful status for it, and
+// returns how many were scheduled.
+func (c Config) rebuildFailedPRs(ctx context.Context, repo, statusContext string) (int, error) {
+	// get the build
+	build, err := c.getBuildByContextAndRepo(statusContext, repo)
+	if err != nil {
+		return 0, err
+	}
+
+	// get PRs that have failed for the context
+	nums, err := c.getFailedPRs(build.Context, repo)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx = withPriority(ctx, priorityCron)
+
+	var scheduled, held int
+	for _, prNum := range nums {
+		// drafts and work in progress are not rebuilt
+		ok, err := c.holdPRBuilds(repo, prNum)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if ok {
+			held++
+			continue
+		}
+
+		// schedule the jenkins build
+		if err := c.scheduleJenkinsBuild(ctx, repo, prNum, "", build); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		scheduled++
+	}
+
+	if scheduled+held < len(nums) {
+		return scheduled, fmt.Errorf("scheduled %d of %d failed pull requests of %s", scheduled, len(nums)-held, repo)
+	}
+	return scheduled, nil
+}
+
+// buildBranch schedules the build for a context of the head of a branch.
+func (c Config) buildBranch(ctx context.Context, repoName, statusContext, branch string) error {
+	build, err := c.getBuildByContextAndRepo(statusContext, repoName)
+	if err != nil {
+		return err
+	}
+
+	// parse git repo for username
+	// and repo name
+	r := strings.SplitN(repoName, "/", 2)
+	if len(r) < 2 {
+		return fmt.Errorf("repo name could not be parsed: %s", repoName)
+	}
+
+	// initialize github client
+	gh := octokat.NewClient()
+	gh = gh.WithToken(c.GHToken)
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	commit, err := gh.Commit(repo, branch, &octokat.Options{})
+	if err != nil {
+		return fmt.Errorf("getting branch %s for %s failed: %v", branch, repoName, err)
+	}
+
+	return c.schedulePushBuild(ctx, repoName, branch, "", commit.Sha, build)
+}
+
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		logrus.Errorf("%q is not a valid method", r.Method)
+		w.WriteHeader(405)
+		return
+	}
+
+	tasks := []taskStatus{}
+	for _, t := range schedules.tasks {
+		tasks = append(tasks, t.status())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tasks); err != nil {
+		logrus.Errorf("encoding the schedules as json failed: %v", err)
+	}
+}
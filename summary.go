@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/crosbymichael/octokat"
+)
+
+// defaultSummaryContext is the context of the summary status if the config
+// does not say otherwise.
+const defaultSummaryContext = "leeroy/summary"
+
+// requiredContexts is the set of contexts that have to pass for the head of a
+// pull request.
+type requiredContexts struct {
+	pr       int // 0 for the commits of staging branches
+	contexts map[string]bool
+	updated  time.Time
+}
+
+// summaryStore remembers which contexts are required for the heads of pull
+// requests, as leeroy decided which builds to run for them.
+type summaryStore struct {
+	mu       sync.Mutex
+	required map[string]*requiredContexts // repo@sha -> contexts
+}
+
+var summaries = &summaryStore{required: map[string]*requiredContexts{}}
+
+func summaryKey(repo, sha string) string {
+	return repo + "@" + sha
+}
+
+// add requires the contexts for a commit of a pull request, next to the ones
+// already required.
+func (s *summaryStore) add(repo, sha string, pr int, contexts ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// forget commits as long after their last change as the tracker does
+	for k, r := range s.required {
+		if time.Since(r.updated) > trackerRetention {
+			delete(s.required, k)
+		}
+	}
+
+	r, ok := s.required[summaryKey(repo, sha)]
+	if !ok {
+		r = &requiredContexts{pr: pr, contexts: map[string]bool{}}
+		s.required[summaryKey(repo, sha)] = r
+	}
+	for _, c := range contexts {
+		r.contexts[c] = true
+	}
+	r.updated = time.Now()
+}
+
+// requires returns if the context is required for a commit, and the pull
+// request of the commit.
+func (s *summaryStore) requires(repo, sha, context string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.required[summaryKey(repo, sha)]
+	if !ok || !r.contexts[context] {
+		return 0, false
+	}
+	return r.pr, true
+}
+
+// get returns the sorted contexts required for a commit.
+func (s *summaryStore) get(repo, sha string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.required[summaryKey(repo, sha)]
+	if !ok {
+		return nil, false
+	}
+
+	var contexts []string
+	for c := range r.contexts {
+		contexts = append(contexts, c)
+	}
+	sort.Strings(contexts)
+	return contexts, true
+}
+
+func (rc RepoConfig) summaryContext() string {
+	if rc.SummaryContext == "" {
+		return defaultSummaryContext
+	}
+	return rc.SummaryContext
+}
+
+// requireContexts records the contexts of the builds scheduled for the head
+// of a pull request, and of the pipelines that build it on their own, and
+// updates the summary status.
+func (c Config) requireContexts(repoName, sha string, number int, builds []Build) {
+	if !c.getRepoConfig(repoName).Summary {
+		return
+	}
+
+	var contexts []string
+	for _, build := range builds {
+		if build.Job != "" {
+			contexts = append(contexts, build.Context)
+		}
+	}
+	for _, build := range c.Builds {
+		if build.Repo == repoName && build.IsPipeline && !build.Custom && !build.isPushBuild() && build.Label == "" {
+			contexts = append(contexts, build.Context)
+		}
+	}
+	summaries.add(repoName, sha, number, contexts...)
+
+	if err := c.updateSummary(repoName, sha, number); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// updateSummary sets the summary status of the head of a pull request from
+// the statuses of the contexts required for it. It is pending until all of
+// them reported a final state and a success only if all of them passed.
+func (c Config) updateSummary(repoName, sha string, number int) error {
+	rc := c.getRepoConfig(repoName)
+	if !rc.Summary {
+		return nil
+	}
+
+	required, states, err := c.requiredStates(repoName, sha)
+	if err != nil {
+		return err
+	}
+	if len(required) == 0 {
+		return nil
+	}
+
+	state, desc := summarize(required, states)
+	url := fmt.Sprintf("https://github.com/%s/pull/%d", repoName, number)
+	return c.updateGithubStatus(repoName, rc.summaryContext(), sha, state, desc, url)
+}
+
+// requiredStates returns the contexts required for a commit and the latest
+// state of each context of the commit.
+func (c Config) requiredStates(repoName, sha string) ([]string, map[string]string, error) {
+	r := strings.SplitN(repoName, "/", 2)
+	if len(r) < 2 {
+		return nil, nil, fmt.Errorf("repo name could not be parsed: %s", repoName)
+	}
+
+	// initialize github client
+	gh := octokat.NewClient()
+	gh = gh.WithToken(c.GHToken)
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	// the statuses are ordered from newest to oldest
+	statuses, err := gh.Statuses(repo, sha, &octokat.Options{
+		QueryParams: map[string]string{"per_page": "100"},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting status for %s for %s failed: %v", sha, repoName, err)
+	}
+	states := map[string]string{}
+	for _, status := range statuses {
+		if _, ok := states[status.Context]; !ok {
+			states[status.Context] = status.State
+		}
+	}
+
+	required, ok := summaries.get(repoName, sha)
+	if !ok {
+		// leeroy did not schedule the builds of the commit, or forgot about
+		// them since, so require the builds that set a status on it
+		for _, build := range c.Builds {
+			if _, ok := states[build.Context]; ok && build.Repo == repoName {
+				required = append(required, build.Context)
+			}
+		}
+		sort.Strings(required)
+	}
+
+	return required, states, nil
+}
+
+// summarize returns the state and description of the summary status from
+// the latest states of the contexts.
+func summarize(required []string, states map[string]string) (string, string) {
+	var failed, reported []string
+	for _, context := range required {
+		switch states[context] {
+		case "failure", "error":
+			failed = append(failed, context)
+			reported = append(reported, context)
+		case "success":
+			reported = append(reported, context)
+		}
+	}
+
+	switch {
+	case len(reported) < len(required):
+		desc := fmt.Sprintf("%d of %d required checks reported", len(reported), len(required))
+		if len(failed) > 0 {
+			desc += ", failed: " + strings.Join(failed, ", ")
+		}
+		return "pending", desc
+	case len(failed) > 0:
+		return "failure", "Failed: " + strings.Join(failed, ", ")
+	}
+
+	return "success", fmt.Sprintf("All %d required checks passed", len(required))
+}
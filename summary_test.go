@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSummaryStore(t *testing.T) {
+	s := &summaryStore{required: map[string]*requiredContexts{}}
+	s.add("docker/docker", "abc", 1, "janky", "windows")
+	s.add("docker/docker", "abc", 1, "janky", "continuous-integration/jenkins/pr-merge")
+
+	contexts, ok := s.get("docker/docker", "abc")
+	if expected := []string{"continuous-integration/jenkins/pr-merge", "janky", "windows"}; !ok || !reflect.DeepEqual(contexts, expected) {
+		t.Fatalf("expected the contexts %v to be required, were %v", expected, contexts)
+	}
+
+	if pr, ok := s.requires("docker/docker", "abc", "continuous-integration/jenkins/pr-merge"); !ok || pr != 1 {
+		t.Fatalf("expected the pipeline to be required for #1, was %d", pr)
+	}
+	if _, ok := s.requires("docker/docker", "abc", "leeroy/summary"); ok {
+		t.Fatal("expected a context that was not added not to be required")
+	}
+	if _, ok := s.requires("docker/docker", "def", "janky"); ok {
+		t.Fatal("expected nothing to be required for another commit")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	required := []string{"janky", "windows"}
+
+	tests := []struct {
+		states   map[string]string
+		expected string
+	}{
+		{map[string]string{"janky": "success", "windows": "success"}, "success"},
+		{map[string]string{"janky": "success"}, "pending"},
+		{map[string]string{"janky": "success", "windows": "pending"}, "pending"},
+		{map[string]string{"janky": "failure", "windows": "pending"}, "pending"},
+		{map[string]string{"janky": "failure", "windows": "success"}, "failure"},
+	}
+	for _, test := range tests {
+		if state, _ := summarize(required, test.states); state != test.expected {
+			t.Fatalf("expected %v to be summarized as %s, was %s", test.states, test.expected, state)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/docker/leeroy/jenkins"
+)
+
+// trackerRetention is how long builds are remembered after they completed.
+const trackerRetention = 72 * time.Hour
+
+// trackedBuild describes a jenkins build leeroy scheduled for a commit.
+type trackedBuild struct {
+	Repo      string
+	PR        int
+	Sha       string
+	BaseSha   string
+	Job       string
+	Jenkins   string
+	Context   string
+	QueueID   int
+	Number    int
+	URL       string
+	State     string
+	Scheduled time.Time
+	Updated   time.Time
+
+	// Superseded are the earlier builds of the job for the commit the build
+	// replaced, whose notifications are ignored.
+	Superseded []supersededBuild
+}
+
+// supersededBuild identifies a build that was replaced by a newer build of the
+// same job and commit.
+type supersededBuild struct {
+	QueueID int
+	Number  int
+}
+
+// completed returns if jenkins reported the final state of the build.
+func (b trackedBuild) completed() bool {
+	return b.State != "" && b.State != "pending"
+}
+
+// matches returns if a jenkins notification is about the tracked build.
+func (b trackedBuild) matches(j jenkins.Build) bool {
+	if j.QueueID != 0 {
+		return j.QueueID == b.QueueID
+	}
+
+	return b.Number == 0 || b.Number == j.Number
+}
+
+// supersedes returns if a jenkins notification is about an earlier build of
+// the same job and commit that the tracked build replaced. Builds leeroy does
+// not know about, like the ones started from the jenkins UI, are not.
+func (b trackedBuild) supersedes(j jenkins.Build) bool {
+	for _, s := range b.Superseded {
+		if j.QueueID != 0 && j.QueueID == s.QueueID {
+			return true
+		}
+		if j.QueueID == 0 && s.Number != 0 && j.Number == s.Number {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildTracker records which jenkins queue items and builds belong to which
+// commit and job.
+type buildTracker struct {
+	mu     sync.Mutex
+	builds map[string]map[string]*trackedBuild // sha -> master/job -> build
+}
+
+// jobKey identifies a job across the jenkins masters, as jobs of the same
+// name can run on more than one of them.
+func jobKey(jenkins, job string) string {
+	return jenkins + "/" + job
+}
+
+var tracker = newBuildTracker()
+
+func newBuildTracker() *buildTracker {
+	return &buildTracker{
+		builds: map[string]map[string]*trackedBuild{},
+	}
+}
+
+// add records a newly scheduled build, replacing an earlier build of the
+// same job for the commit.
+func (t *buildTracker) add(b trackedBuild) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune()
+
+	now := time.Now()
+	b.Scheduled, b.Updated = now, now
+	if t.builds[b.Sha] == nil {
+		t.builds[b.Sha] = map[string]*trackedBuild{}
+	}
+	key := jobKey(b.Jenkins, b.Job)
+	if old, ok := t.builds[b.Sha][key]; ok {
+		b.Superseded = append(old.Superseded, supersededBuild{QueueID: old.QueueID, Number: old.Number})
+	}
+	t.builds[b.Sha][key] = &b
+}
+
+// get returns the build scheduled for a job on a jenkins master and commit.
+func (t *buildTracker) get(sha, jenkins, job string) (trackedBuild, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if b, ok := t.builds[sha][jobKey(jenkins, job)]; ok {
+		return *b, true
+	}
+
+	return trackedBuild{}, false
+}
+
+// update applies fn to the build scheduled for a job on a jenkins master and
+// commit, if there is one, and returns if it was found.
+func (t *buildTracker) update(sha, jenkins, job string, fn func(b *trackedBuild)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.builds[sha][jobKey(jenkins, job)]
+	if !ok {
+		return false
+	}
+
+	fn(b)
+	b.Updated = time.Now()
+	return true
+}
+
+// forPR returns the builds of a job on a jenkins master scheduled for a pull
+// request.
+func (t *buildTracker) forPR(repo string, pr int, jenkins, job string) (builds []trackedBuild) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, jobs := range t.builds {
+		if b, ok := jobs[jobKey(jenkins, job)]; ok && b.Repo == repo && b.PR == pr {
+			builds = append(builds, *b)
+		}
+	}
+
+	return builds
+}
+
+// pending returns the builds jenkins has not reported a final state for.
+func (t *buildTracker) pending() (builds []trackedBuild) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, jobs := range t.builds {
+		for _, b := range jobs {
+			if !b.completed() {
+				builds = append(builds, *b)
+			}
+		}
+	}
+
+	return builds
+}
+
+// prune drops completed builds older than the retention period. The caller
+// must hold the lock.
+func (t *buildTracker) prune() {
+	cutoff := time.Now().Add(-trackerRetention)
+	for sha, jobs := range t.builds {
+		for job, b := range jobs {
+			if b.completed() && b.Updated.Before(cutoff) {
+				delete(jobs, job)
+			}
+		}
+		if len(jobs) == 0 {
+			delete(t.builds, sha)
+		}
+	}
+}
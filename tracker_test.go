@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/leeroy/jenkins"
+)
+
+func TestBuildTrackerMasters(t *testing.T) {
+	tr := newBuildTracker()
+	tr.add(trackedBuild{Repo: "docker/docker", PR: 1, Sha: "abc", Job: "Docker-PRs", QueueID: 1, State: "pending"})
+	tr.add(trackedBuild{Repo: "docker/docker", PR: 1, Sha: "abc", Jenkins: "windows", Job: "Docker-PRs", QueueID: 2, State: "pending"})
+
+	// the same job on two masters is tracked separately
+	tr.update("abc", "windows", "Docker-PRs", func(b *trackedBuild) {
+		b.Number = 7
+		b.State = "success"
+	})
+	b, ok := tr.get("abc", "", "Docker-PRs")
+	if !ok || b.QueueID != 1 || b.State != "pending" {
+		t.Fatalf("expected the build on the default master to be pending, was %#v", b)
+	}
+	b, ok = tr.get("abc", "windows", "Docker-PRs")
+	if !ok || b.QueueID != 2 || !b.completed() {
+		t.Fatalf("expected the build on the windows master to be completed, was %#v", b)
+	}
+
+	if builds := tr.forPR("docker/docker", 1, "windows", "Docker-PRs"); len(builds) != 1 || builds[0].QueueID != 2 {
+		t.Fatalf("expected the build of the windows master, was %#v", builds)
+	}
+	if pending := tr.pending(); len(pending) != 1 || pending[0].Jenkins != "" {
+		t.Fatalf("expected only the build on the default master to be pending, was %#v", pending)
+	}
+}
+
+func TestTrackedBuildMatches(t *testing.T) {
+	b := trackedBuild{QueueID: 5, Number: 3}
+
+	if !b.matches(jenkins.Build{QueueID: 5, Number: 4}) {
+		t.Fatal("expected a build of the same queue item to match")
+	}
+	if b.matches(jenkins.Build{QueueID: 6, Number: 3}) {
+		t.Fatal("expected a build of another queue item not to match")
+	}
+	if !b.matches(jenkins.Build{Number: 3}) || b.matches(jenkins.Build{Number: 2}) {
+		t.Fatal("expected builds without a queue item to match by number")
+	}
+}
+
+func TestTrackedBuildSupersedes(t *testing.T) {
+	tr := newBuildTracker()
+	tr.add(trackedBuild{Repo: "docker/docker", PR: 1, Sha: "abc", Job: "Docker-PRs", QueueID: 1, Number: 3, State: "pending"})
+	tr.add(trackedBuild{Repo: "docker/docker", PR: 1, Sha: "abc", Job: "Docker-PRs", QueueID: 2, State: "pending"})
+
+	b, _ := tr.get("abc", "", "Docker-PRs")
+	if !b.supersedes(jenkins.Build{QueueID: 1, Number: 3}) || !b.supersedes(jenkins.Build{Number: 3}) {
+		t.Fatal("expected the replaced build to be superseded")
+	}
+	// a build rebuilt from the jenkins UI has a queue item leeroy does not
+	// know about
+	if b.supersedes(jenkins.Build{QueueID: 7, Number: 5}) || b.supersedes(jenkins.Build{QueueID: 2}) {
+		t.Fatal("expected unknown and tracked builds not to be superseded")
+	}
+}
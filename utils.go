@@ -1,15 +1,38 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/crosbymichael/octokat"
 	"github.com/docker/leeroy/github"
+	"github.com/docker/leeroy/jenkins"
+)
+
+const (
+	// queuePollInterval is how often the jenkins queue is checked for a
+	// build leeroy scheduled.
+	queuePollInterval = 10 * time.Second
+
+	// maxQueueWait is how long leeroy waits for a build to leave the queue.
+	maxQueueWait = 6 * time.Hour
+
+	// maxStatusDescription is the longest description github accepts for a
+	// commit status.
+	maxStatusDescription = 140
+
+	// testMergeAttempts is how often github is asked for the test merge
+	// commit of a pull request before giving up.
+	testMergeAttempts = 6
 )
 
 // Commit describes information in a commit
@@ -26,6 +49,15 @@ func (c Config) getBuilds(baseRepo string, isCustom bool, includePipeline bool)
 			if !includePipeline && build.IsPipeline {
 				continue
 			}
+			// builds of pushed branches and tags are not run for pull
+			// requests
+			if build.isPushBuild() {
+				continue
+			}
+			// builds triggered by labels are only run on demand
+			if build.Label != "" {
+				continue
+			}
 			builds = append(builds, build)
 		}
 	}
@@ -37,9 +69,89 @@ func (c Config) getBuilds(baseRepo string, isCustom bool, includePipeline bool)
 	return builds, nil
 }
 
-func (c Config) getBuildByJob(job string) (build Build, err error) {
+// getPushBuilds returns the builds of a repository for a pushed branch or
+// tag.
+func (c Config) getPushBuilds(repo, branch, tag string) (builds []Build) {
+	for _, build := range c.Builds {
+		if build.Repo == repo && build.matchesPush(branch, tag) {
+			builds = append(builds, build)
+		}
+	}
+
+	return builds
+}
+
+// getLabelBuilds returns the builds of a repository that are triggered by
+// one of the labels.
+func (c Config) getLabelBuilds(baseRepo string, labels ...string) (builds []Build) {
+	for _, build := range c.Builds {
+		if build.Repo != baseRepo || build.Label == "" || build.Custom {
+			continue
+		}
+		for _, label := range labels {
+			if build.Label == label {
+				builds = append(builds, build)
+				break
+			}
+		}
+	}
+
+	return builds
+}
+
+// removeBuildLabel removes the label that triggered a build from the pull
+// request, if the build asks for it.
+func (c Config) removeBuildLabel(baseRepo string, number int, build Build) error {
+	if build.Label == "" || !build.RemoveLabel {
+		return nil
+	}
+
+	r := strings.SplitN(baseRepo, "/", 2)
+	if len(r) < 2 {
+		return fmt.Errorf("repo name could not be parsed: %s", baseRepo)
+	}
+
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	if err := g.RemoveLabel(repo, number, build.Label); err != nil {
+		return fmt.Errorf("removing label %s from %s#%d failed: %v", build.Label, baseRepo, number, err)
+	}
+
+	logrus.Infof("Removed label %s from %s#%d after build %s completed", build.Label, baseRepo, number, build.Job)
+	return nil
+}
+
+// isPushBuild returns if the build is run for pushed branches and tags.
+func (b Build) isPushBuild() bool {
+	return len(b.Branches) > 0 || len(b.Tags) > 0
+}
+
+// matchesPush returns if the build is run for a pushed branch or tag.
+func (b Build) matchesPush(branch, tag string) bool {
+	patterns, name := b.Branches, branch
+	if tag != "" {
+		patterns, name = b.Tags, tag
+	}
+
+	for _, p := range patterns {
+		if ok, err := path.Match(p, name); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c Config) getBuildByJob(jenkinsName, job string) (build Build, err error) {
 	for _, build := range c.Builds {
-		if build.Job == job {
+		if build.Job == job && build.Jenkins == jenkinsName {
 			return build, nil
 		}
 	}
@@ -47,6 +159,97 @@ func (c Config) getBuildByJob(job string) (build Build, err error) {
 	return build, fmt.Errorf("Could not find config for %s", job)
 }
 
+// getJenkins returns the jenkins master with the given name, or the default
+// one if the name is empty.
+func (c Config) getJenkins(name string) (*jenkins.Client, error) {
+	if name == "" {
+		if c.Jenkins == nil {
+			return nil, errors.New("no default jenkins master is configured")
+		}
+		return c.Jenkins, nil
+	}
+
+	j, ok := c.JenkinsMasters[name]
+	if !ok || j == nil {
+		return nil, fmt.Errorf("Could not find config for jenkins master %s", name)
+	}
+
+	return j, nil
+}
+
+// getJenkinsForNotification returns the name of the jenkins master a
+// notification came from. The master is found by the token the notification
+// was sent with, or else by the master whose base url the build url starts
+// with.
+func (c Config) getJenkinsForNotification(token, buildURL string) (string, error) {
+	if token != "" {
+		if c.Jenkins != nil && c.Jenkins.NotificationToken == token {
+			return "", nil
+		}
+		for name, j := range c.JenkinsMasters {
+			if j.NotificationToken == token {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("Could not find jenkins master for notification token %q", token)
+	}
+
+	// use the longest matching base url, in case masters are served from
+	// paths below each other
+	var (
+		found   bool
+		master  string
+		longest int
+	)
+	match := func(name string, j *jenkins.Client) {
+		base := strings.TrimSuffix(j.Baseurl, "/") + "/"
+		if strings.HasPrefix(buildURL, base) && len(base) > longest {
+			found, master, longest = true, name, len(base)
+		}
+	}
+	if c.Jenkins != nil {
+		match("", c.Jenkins)
+	}
+	for name, j := range c.JenkinsMasters {
+		match(name, j)
+	}
+	if !found {
+		return "", fmt.Errorf("Could not find jenkins master for build %s", buildURL)
+	}
+
+	return master, nil
+}
+
+// getRepoConfig returns the settings of a repository.
+func (c Config) getRepoConfig(repo string) RepoConfig {
+	return c.Repos[repo]
+}
+
+// isBaseBranch returns if the base push policy applies to a branch.
+func (rc RepoConfig) isBaseBranch(branch string) bool {
+	if len(rc.BaseBranches) == 0 {
+		return true
+	}
+
+	for _, b := range rc.BaseBranches {
+		if b == branch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rebuildInterval returns the time between scheduling the rebuilds of pull
+// requests.
+func (rc RepoConfig) rebuildInterval() time.Duration {
+	if rc.RebuildInterval > 0 {
+		return time.Duration(rc.RebuildInterval) * time.Second
+	}
+
+	return defaultRebuildInterval
+}
+
 func (c Config) getBuildByContextAndRepo(context, repo string) (build Build, err error) {
 	if context == "" {
 		context = DEFAULTCONTEXT
@@ -101,6 +304,11 @@ func (c Config) updateGithubStatus(repoName, context, sha, state, desc, buildURL
 		UserName: r[0],
 	}
 
+	// github rejects descriptions longer than 140 characters
+	if len(desc) > maxStatusDescription {
+		desc = desc[:maxStatusDescription-3] + "..."
+	}
+
 	status := &octokat.StatusOptions{
 		State:       state,
 		Description: desc,
@@ -115,6 +323,84 @@ func (c Config) updateGithubStatus(repoName, context, sha, state, desc, buildURL
 	return nil
 }
 
+// buildResultStatus returns the github status state and description for the
+// result of a completed jenkins build.
+func buildResultStatus(job string, number int, result string) (state, desc string, err error) {
+	desc = fmt.Sprintf("Jenkins build %s %d", job, number)
+
+	switch result {
+	case "SUCCESS":
+		state = "success"
+		desc += " has succeeded"
+	case "FAILURE":
+		state = "failure"
+		desc += " has failed"
+	case "UNSTABLE":
+		state = "failure"
+		desc += " was unstable"
+	case "ABORTED":
+		state = "error"
+		desc += " has encountered an error"
+	default:
+		return "", "", fmt.Errorf("Did not understand %q build status", result)
+	}
+
+	return state, desc, nil
+}
+
+// withBaseSha adds the base commit a merge commit was tested against to a
+// status description.
+func withBaseSha(desc, baseSha string) string {
+	if baseSha == "" {
+		return desc
+	}
+
+	return fmt.Sprintf("%s (merged with base %s)", desc, shortSha(baseSha))
+}
+
+// shortSha returns the abbreviated form of a commit sha.
+func shortSha(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+
+	return sha
+}
+
+// prKey identifies a pull request across repositories, like "docker/docker#1".
+func prKey(repo string, pr int) string {
+	return fmt.Sprintf("%s#%d", repo, pr)
+}
+
+// getTestMergeCommit waits for github to create the test merge commit for the
+// head of a pull request.
+func (c Config) getTestMergeCommit(baseRepo string, pr *octokat.PullRequest) (*github.TestMergeCommit, error) {
+	r := strings.SplitN(baseRepo, "/", 2)
+	if len(r) < 2 {
+		return nil, fmt.Errorf("repo name could not be parsed: %s", baseRepo)
+	}
+
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	merge, err := g.WaitForTestMergeCommit(repo, pr.Number, pr.Head.Sha, testMergeAttempts, time.Second)
+	if err == github.ErrNotMergeable {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting test merge commit of %s#%d failed: %v", baseRepo, pr.Number, err)
+	}
+
+	logrus.Infof("Testing %s#%d as merge commit %s of %s into %s", baseRepo, pr.Number, merge.Sha, merge.HeadSha, merge.BaseSha)
+	return merge, nil
+}
+
 func hasStatus(gh *octokat.Client, repo octokat.Repo, sha, context string) bool {
 	statuses, err := gh.Statuses(repo, sha, &octokat.Options{})
 	if err != nil {
@@ -196,23 +482,32 @@ func (c Config) getShas(owner, name, context string, number int, ref string) (sh
 	return shas, pr, nil
 }
 
-func (c Config) scheduleJenkinsBuild(baseRepo string, number int, ref string, build Build) error {
-	// setup the jenkins client
-	j := &config.Jenkins
-
+func (c Config) scheduleJenkinsBuild(ctx context.Context, baseRepo string, number int, ref string, build Build) error {
 	// make sure we even want to build
 	if build.Job == "" {
 		return nil
 	}
 
-	// cancel any existing builds if we can, before sheduling another
-	if err := j.CancelBuildsForPR(build.Job, strconv.Itoa(number)); err != nil {
-		logrus.Warnf("Trying to cancel existing builds for job %s, pr %d failed: %v", build.Job, number, err)
+	// setup the jenkins client
+	j, err := c.getJenkins(build.Jenkins)
+	if err != nil {
+		return err
 	}
 
-	// find the comments about failed builds and remove them
-	if err := config.removeFailedBuildComment(baseRepo, build.Job, number); err != nil {
-		logrus.Error(err)
+	// do not run the code of untrusted authors before it is approved
+	if number != 0 {
+		waiting, err := c.awaitingApproval(baseRepo, number, build)
+		if err != nil {
+			return err
+		}
+		if waiting {
+			return nil
+		}
+	}
+
+	// cancel any existing builds if we can, before sheduling another
+	if err := c.cancelBuildsForPR(ctx, baseRepo, number, build); err != nil {
+		logrus.Warnf("Trying to cancel existing builds for job %s, pr %d failed: %v", build.Job, number, err)
 	}
 
 	// parse git repo for username
@@ -238,28 +533,309 @@ func (c Config) scheduleJenkinsBuild(baseRepo string, number int, ref string, bu
 				prNumber = pr.Number
 				ref = pr.Base.Ref
 			}
-			if err := j.BuildPipeline(build.Job, prNumber, ref); err != nil {
+			if err := j.BuildPipeline(ctx, build.Job, build.Multibranch.SubJob(prNumber, ref)); err != nil {
 				return fmt.Errorf("scheduling jenkins pipeline build failed with: %v", err)
 			}
 		} else {
-			// update the github status
-			if err := c.updateGithubStatus(baseRepo, build.Context, sha, "pending", "Jenkins build is being scheduled", c.Jenkins.Baseurl); err != nil {
+			data := newParameterData(c, baseRepo, sha, pr)
+
+			// only the head of a pull request has a test merge commit
+			if build.TestMerge && sha == pr.Head.Sha {
+				data.merge, err = c.getTestMergeCommit(baseRepo, pr)
+				if err == github.ErrNotMergeable {
+					desc := fmt.Sprintf("Pull request cannot be merged into %s", pr.Base.Ref)
+					if err := c.updateGithubStatus(baseRepo, build.Context, sha, "error", desc, j.Baseurl); err != nil {
+						return err
+					}
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			// update the github status, noting the base commit the merge
+			// is tested against
+			var baseSha string
+			if data.merge != nil {
+				baseSha = data.merge.BaseSha
+			}
+			desc := withBaseSha("Jenkins build is being scheduled", baseSha)
+			if err := c.updateGithubStatus(baseRepo, build.Context, sha, "pending", desc, j.Baseurl); err != nil {
 				return err
 			}
 
 			// setup the parameters
-			htmlURL := fmt.Sprintf("https://github.com/%s/pull/%d", baseRepo, pr.Number)
-			headRepo := fmt.Sprintf("%s/%s", pr.Head.Repo.Owner.Login, pr.Head.Repo.Name)
-			parameters := fmt.Sprintf("GIT_BASE_REPO=%s&GIT_HEAD_REPO=%s&GIT_SHA1=%s&GITHUB_URL=%s&PR=%d&BASE_BRANCH=%s", baseRepo, headRepo, sha, htmlURL, pr.Number, pr.Base.Ref)
-			if err := j.BuildWithParameters(build.Job, parameters); err != nil {
-				return fmt.Errorf("scheduling jenkins build failed: %v", err)
+			parameters, err := build.buildParameters(data)
+			if err != nil {
+				return err
+			}
+			sha, number := sha, pr.Number
+			start := func(ctx context.Context) error {
+				q, err := j.BuildWithParameters(ctx, build.Job, parameters)
+				if err != nil {
+					return fmt.Errorf("scheduling jenkins build failed: %v", err)
+				}
+
+				// remember the queue item so we can find the build later on
+				tracker.add(trackedBuild{
+					Repo:    baseRepo,
+					PR:      number,
+					Sha:     sha,
+					BaseSha: baseSha,
+					Job:     build.Job,
+					Jenkins: build.Jenkins,
+					Context: build.Context,
+					QueueID: q.ID,
+					State:   "pending",
+				})
+				go c.followQueueItem(j, baseRepo, sha, build, q)
+				return nil
+			}
+
+			// send the build to jenkins once it fits under the limits
+			if err := c.dispatch(ctx, dispatchItem{
+				Repo:    baseRepo,
+				PR:      number,
+				Sha:     sha,
+				Branch:  pr.Base.Ref,
+				Job:     build.Job,
+				Jenkins: build.Jenkins,
+				start:   start,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// cancelBuildsForPR cancels the queued and running builds of a job for a pull
+// request. Builds leeroy scheduled are cancelled by their queue item or build
+// number, otherwise jenkins is searched for builds with a matching PR
+// parameter.
+func (c Config) cancelBuildsForPR(ctx context.Context, baseRepo string, number int, build Build) error {
+	j, err := c.getJenkins(build.Jenkins)
+	if err != nil {
+		return err
+	}
+
+	// drop the builds that were not sent to jenkins yet
+	dispatcher.cancel(baseRepo, number, build.Jenkins, build.Job)
+
+	tracked := tracker.forPR(baseRepo, number, build.Jenkins, build.Job)
+	if len(tracked) == 0 {
+		return j.CancelBuildsForPR(ctx, build.Job, strconv.Itoa(number))
+	}
+
+	if env := os.Getenv("LEEROY_KEEP_OLD_BUILD_RUNNING"); env != "" {
+		return errors.New("LEEROY_KEEP_OLD_BUILD_RUNNING is set")
+	}
+
+	var e string
+	for _, b := range tracked {
+		if b.completed() {
+			continue
+		}
+
+		if b.Number != 0 {
+			if err := j.CancelBuild(ctx, b.Job, strconv.Itoa(b.Number), false); err != nil {
+				e += fmt.Sprintf("cancelling running build %d for job %s, pr %d failed: %v; ", b.Number, b.Job, number, err)
+				continue
+			}
+			logrus.Infof("Cancelled running build (%d) for job %s, pr %d", b.Number, b.Job, number)
+		} else {
+			if err := j.CancelQueuedBuild(ctx, b.Job, b.QueueID); err != nil {
+				e += fmt.Sprintf("cancelling queued build %d for job %s, pr %d failed: %v; ", b.QueueID, b.Job, number, err)
+				continue
 			}
+			logrus.Infof("Cancelled queued build (%d) for job %s, pr %d", b.QueueID, b.Job, number)
 		}
+
+		// keep the build around so its notification can be ignored
+		tracker.update(b.Sha, b.Jenkins, b.Job, func(t *trackedBuild) {
+			t.State = "cancelled"
+		})
+	}
+
+	if e != "" {
+		return errors.New(e)
 	}
 
 	return nil
 }
 
+// cancelPRBuilds cancels the queued and running builds of all the jobs of a
+// pull request, and sets the status of the builds that were pending to
+// cancelled.
+func (c Config) cancelPRBuilds(ctx context.Context, baseRepo string, pr *octokat.PullRequest, reason string) error {
+	builds, err := c.getBuilds(baseRepo, false, false)
+	if err != nil {
+		return err
+	}
+	// the builds triggered by labels may be running too
+	for _, build := range c.Builds {
+		if build.Repo == baseRepo && build.Label != "" && !build.Custom {
+			builds = append(builds, build)
+		}
+	}
+
+	for _, build := range builds {
+		if build.Job == "" {
+			continue
+		}
+
+		// check before cancelling, which marks the tracked builds
+		pending, err := c.isPending(baseRepo, pr.Head.Sha, build)
+		if err != nil {
+			logrus.Warn(err)
+		}
+
+		if err := c.cancelBuildsForPR(ctx, baseRepo, pr.Number, build); err != nil {
+			logrus.Warnf("Trying to cancel existing builds for job %s, pr %d failed: %v", build.Job, pr.Number, err)
+		}
+
+		if !pending {
+			continue
+		}
+
+		j, err := c.getJenkins(build.Jenkins)
+		if err != nil {
+			return err
+		}
+		desc := fmt.Sprintf("Jenkins build was cancelled, the pull request was %s", reason)
+		if err := c.updateGithubStatus(baseRepo, build.Context, pr.Head.Sha, "pending", desc, j.Baseurl); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// isPending returns if the build of a commit has not completed yet. Builds
+// leeroy does not remember are looked up in the github statuses.
+func (c Config) isPending(repoName, sha string, build Build) (bool, error) {
+	if t, ok := tracker.get(sha, build.Jenkins, build.Job); ok {
+		return !t.completed(), nil
+	}
+
+	// parse git repo for username
+	// and repo name
+	r := strings.SplitN(repoName, "/", 2)
+	if len(r) < 2 {
+		return false, fmt.Errorf("repo name could not be parsed: %s", repoName)
+	}
+
+	// initialize github client
+	gh := octokat.NewClient()
+	gh = gh.WithToken(c.GHToken)
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	// the statuses are ordered from newest to oldest
+	statuses, err := gh.Statuses(repo, sha, &octokat.Options{})
+	if err != nil {
+		return false, fmt.Errorf("getting status for %s for %s failed: %v", sha, repoName, err)
+	}
+	for _, status := range statuses {
+		if status.Context == build.Context {
+			return status.State == "pending", nil
+		}
+	}
+
+	return false, nil
+}
+
+// followQueueItem waits for jenkins to start the build for a queue item and
+// records its number. Until jenkins reports the build has started, the
+// pending status links to the queue item and says why it is waiting, and
+// then to the console of the build.
+func (c Config) followQueueItem(j *jenkins.Client, baseRepo, sha string, build Build, q *jenkins.QueuedBuild) {
+	ctx, cancel := context.WithTimeout(context.Background(), maxQueueWait)
+	defer cancel()
+
+	// waiting returns if the queue item is still the latest build for the
+	// commit and jenkins has not notified us about it yet
+	waiting := func() bool {
+		t, ok := tracker.get(sha, build.Jenkins, build.Job)
+		return ok && t.QueueID == q.ID && t.Number == 0 && !t.completed()
+	}
+
+	var lastDesc string
+	progress := func(item *jenkins.QueuedBuild) {
+		desc := "Jenkins build is queued"
+		if position, err := j.QueuePosition(ctx, item.ID); err != nil {
+			logrus.Warnf("Getting the queue position of item %d failed: %v", item.ID, err)
+		} else if position > 0 {
+			desc += fmt.Sprintf(" (position %d)", position)
+		}
+		if item.Why != "" {
+			desc += ": " + item.Why
+		}
+
+		if desc == lastDesc || !waiting() {
+			return
+		}
+		if err := c.updateGithubStatus(baseRepo, build.Context, sha, "pending", desc, q.URL); err != nil {
+			logrus.Error(err)
+			return
+		}
+		lastDesc = desc
+	}
+
+	b, err := j.WaitForBuild(ctx, q.ID, queuePollInterval, progress)
+	if err != nil {
+		logrus.Warnf("Waiting for queue item %d of job %s for %s failed: %v", q.ID, build.Job, sha, err)
+
+		// the build will not start, so it no longer holds a slot of the
+		// dispatcher and the status must not stay pending
+		state, desc := "error", fmt.Sprintf("Waiting for Jenkins build %s failed: %v", build.Job, err)
+		if err == jenkins.ErrQueueItemCancelled {
+			state, desc = "cancelled", fmt.Sprintf("Jenkins build %s was cancelled in the queue", build.Job)
+		}
+		var (
+			failed bool
+			pr     int
+		)
+		tracker.update(sha, build.Jenkins, build.Job, func(t *trackedBuild) {
+			if t.QueueID == q.ID && t.Number == 0 && !t.completed() {
+				t.State = state
+				pr = t.PR
+				failed = true
+			}
+		})
+		if !failed {
+			return
+		}
+		if err := c.updateGithubStatus(baseRepo, build.Context, sha, "error", desc, q.URL); err != nil {
+			logrus.Error(err)
+		}
+		c.buildCompleted(baseRepo, sha, pr)
+		return
+	}
+	logrus.Infof("Queue item %d of job %s for %s started build %d", q.ID, build.Job, sha, b.Number)
+
+	var started bool
+	tracker.update(sha, build.Jenkins, build.Job, func(t *trackedBuild) {
+		if t.QueueID == q.ID && t.Number == 0 && !t.completed() {
+			t.Number = b.Number
+			t.URL = b.URL
+			started = true
+		}
+	})
+	if !started {
+		return
+	}
+
+	desc := fmt.Sprintf("Jenkins build %s %d is starting", build.Job, b.Number)
+	if err := c.updateGithubStatus(baseRepo, build.Context, sha, "pending", desc, b.URL+"console"); err != nil {
+		logrus.Error(err)
+	}
+}
+
 func (c Config) getFailedPRs(context, repoName string) (nums []int, err error) {
 	// parse git repo for username
 	// and repo name
@@ -296,7 +872,19 @@ func (c Config) getFailedPRs(context, repoName string) (nums []int, err error) {
 	return nums, nil
 }
 
-func (c Config) removeFailedBuildComment(repoName, job string, pr int) error {
+// failedBuildCommentPrefix returns how the comments about failed builds of a
+// job on a jenkins master start. The comments of jobs on other masters than
+// the default one name the master, so they are kept apart.
+func failedBuildCommentPrefix(master, job string) string {
+	if master != "" {
+		job = master + "/" + job
+	}
+	return fmt.Sprintf("Job: %s [FAILED", job)
+}
+
+// removeFailedBuildComment removes the comment about a failed job on a jenkins
+// master from a pull request.
+func (c Config) removeFailedBuildComment(repoName, master, job string, pr int) error {
 	// parse git repo for username
 	// and repo name
 	r := strings.SplitN(repoName, "/", 2)
@@ -320,7 +908,7 @@ func (c Config) removeFailedBuildComment(repoName, job string, pr int) error {
 	}
 
 	// find the comments about failed builds and remove them
-	if comment := content.FindComment(fmt.Sprintf("Job: %s [FAILED", job), c.GHUser); comment != nil {
+	if comment := content.FindComment(failedBuildCommentPrefix(master, job), c.GHUser); comment != nil {
 		if err := g.Client().RemoveComment(repo, comment.Id); err != nil {
 			return fmt.Errorf("removing comment from %s#%d for %s failed: %v", repoName, pr, job, err)
 		}
@@ -328,3 +916,49 @@ func (c Config) removeFailedBuildComment(repoName, job string, pr int) error {
 
 	return nil
 }
+
+// setFailedBuildComment adds a comment about a failed job on a jenkins master
+// to a pull request, or edits the comment leeroy added before for the job.
+func (c Config) setFailedBuildComment(repoName, master, job string, pr int, comment string) error {
+	// parse git repo for username
+	// and repo name
+	r := strings.SplitN(repoName, "/", 2)
+	if len(r) < 2 {
+		return fmt.Errorf("repo name could not be parsed: %s", repoName)
+	}
+
+	// initialize github client
+	g := github.GitHub{
+		AuthToken: c.GHToken,
+		User:      c.GHUser,
+	}
+	repo := octokat.Repo{
+		Name:     r[1],
+		UserName: r[0],
+	}
+
+	content, err := g.GetContent(repo, pr, true)
+	if err != nil {
+		return fmt.Errorf("getting pull request content failed: %v", err)
+	}
+
+	// name the master in the comment, and edit the existing comment about
+	// the failed job rather than adding another one for every build
+	prefix := failedBuildCommentPrefix(master, job)
+	comment = strings.Replace(comment, failedBuildCommentPrefix("", job), prefix, 1)
+	existing := content.FindComment(prefix, c.GHUser)
+	if existing == nil {
+		if err := c.addGithubComment(repoName, strconv.Itoa(pr), comment); err != nil {
+			return err
+		}
+		logrus.Infof("added comment about failed job %s to %s#%d", job, repoName, pr)
+		return nil
+	}
+
+	if _, err := g.Client().PatchComment(repo, strconv.Itoa(existing.Id), comment); err != nil {
+		return fmt.Errorf("editing comment on %s#%d for %s failed: %v", repoName, pr, job, err)
+	}
+	logrus.Infof("updated comment about failed job %s on %s#%d", job, repoName, pr)
+
+	return nil
+}